@@ -0,0 +1,105 @@
+package fatfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// MarkModified records that the file at a path has been
+// modified by setting its archive attribute and updating
+// its write timestamp.
+//
+// This should be called after changing a file's contents
+// through its Chain, so that backup tools notice the
+// change.
+// If date is the zero time, the FS clock is used.
+func (f *FS) MarkModified(path string, date time.Time) error {
+	if date.IsZero() {
+		date = f.now()
+	}
+	return essentials.AddCtx("MarkModified", f.updateEntry(path, func(r *RawDirEntry) {
+		r.SetAttr(r.Attr() | Archive)
+		r.SetWrtDate(fatDate(date))
+		r.SetWrtTime(fatTime(date))
+	}))
+}
+
+// ClearArchive clears the archive attribute of the entry
+// at a path, as a backup tool does after backing it up.
+func (f *FS) ClearArchive(path string) error {
+	return essentials.AddCtx("ClearArchive", f.updateEntry(path, func(r *RawDirEntry) {
+		r.SetAttr(r.Attr() &^ Archive)
+	}))
+}
+
+// SetFileSize sets the size recorded in a file's short
+// entry, both on disk and in entry, without changing the
+// file's clusters.
+//
+// The short entry at dirLoc must have the same short name
+// as entry, which guards against writing to the wrong
+// entry if the directory has changed.
+// The size must fit in the 32-bit size field.
+func (f *FS) SetFileSize(entry *DirEntry, dirLoc EntryLocation, size int64) (err error) {
+	defer essentials.AddCtxTo("SetFileSize", &err)
+	if size < 0 {
+		return errors.New("negative size")
+	} else if size >= 1<<32 {
+		return ErrTooLarge
+	}
+	if dirLoc.ByteOffset < 0 || dirLoc.ByteOffset%32 != 0 || dirLoc.ByteOffset >= f.ClusterSize() {
+		return errors.New("invalid entry offset")
+	}
+	raw := entry.Raw()
+	var matched bool
+	loc := rawLocation{cluster: dirLoc.ClusterOffset, offset: dirLoc.ByteOffset}
+	err = updateEntryAt(dirLoc.Dir, loc, func(r *RawDirEntry) {
+		if bytes.Equal(r.Name(), raw.Name()) && !r.IsLongName() {
+			matched = true
+			r.SetFileSize(uint32(size))
+		}
+	})
+	if err != nil {
+		return err
+	} else if !matched {
+		return errors.New("entry does not match the directory")
+	}
+	raw.SetFileSize(uint32(size))
+	return nil
+}
+
+// updateEntry modifies the short entry for a path in
+// place, only writing the sector that contains it.
+func (f *FS) updateEntry(path string, update func(r *RawDirEntry)) error {
+	chain, clusterOffset, byteOffset, err := f.EntryLocation(path)
+	if err != nil {
+		return err
+	}
+	return updateEntryAt(chain, rawLocation{cluster: clusterOffset, offset: byteOffset}, update)
+}
+
+// updateEntryAt modifies the raw entry at a location in a
+// directory chain, only writing the sector that contains
+// it.
+func updateEntryAt(chain *Chain, loc rawLocation, update func(r *RawDirEntry)) error {
+	clusterOffset, byteOffset := loc.cluster, loc.offset
+	if offset, err := chain.Seek(clusterOffset, io.SeekStart); err != nil {
+		return err
+	} else if offset != clusterOffset {
+		return errors.New("directory is shorter than expected")
+	}
+	cluster, err := chain.ReadCluster()
+	if err != nil {
+		return err
+	}
+	var raw RawDirEntry
+	copy(raw[:], cluster[byteOffset:])
+	update(&raw)
+	copy(cluster[byteOffset:], raw[:])
+	sector := byteOffset / SectorSize
+	return chain.writeSectors(cluster, sector, sector)
+}
@@ -0,0 +1,170 @@
+package fatfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestArchiveAttribute(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2016, 1, 2, 3, 4, 6, 0, time.UTC)
+	_, err = CreateFile(NewDir(fs.RootDir()), "notes.txt", bytes.NewReader([]byte("hi")), created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAttr := func(expected bool) *RawDirEntry {
+		entry, err := fs.Lookup("notes.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (entry.Raw().Attr()&Archive != 0) != expected {
+			t.Errorf("expected archive=%v but got attributes 0x%x", expected, entry.Raw().Attr())
+		}
+		return entry.Raw()
+	}
+	checkAttr(true)
+
+	if err := fs.ClearArchive("notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	checkAttr(false)
+
+	modified := time.Date(2017, 5, 6, 7, 8, 10, 0, time.UTC)
+	if err := fs.MarkModified("notes.txt", modified); err != nil {
+		t.Fatal(err)
+	}
+	raw := checkAttr(true)
+	if raw.WrtDate() != fatDate(modified) || raw.WrtTime() != fatTime(modified) {
+		t.Error("write timestamp was not updated")
+	}
+	if raw.CrtDate() != fatDate(created) {
+		t.Error("creation date was changed")
+	}
+
+	if err := fs.ClearArchive("missing.txt"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestSetFileSize(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	for _, name := range []string{"other.txt", "data.bin"} {
+		if _, err := CreateFile(root, name, bytes.NewReader([]byte("hi")), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, err := fs.Lookup("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := fs.EntryLocationOf("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{-1, 1 << 32} {
+		if err := fs.SetFileSize(&entry, loc, size); err == nil {
+			t.Errorf("expected error for size %d", size)
+		}
+	}
+	wrong := loc
+	wrong.ByteOffset = 0
+	if err := fs.SetFileSize(&entry, wrong, 5); err == nil {
+		t.Error("expected error for mismatched location")
+	}
+
+	if err := fs.SetFileSize(&entry, loc, 1234); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Raw().FileSize() != 1234 {
+		t.Errorf("in-memory size not updated: %d", entry.Raw().FileSize())
+	}
+	for name, expected := range map[string]uint32{"data.bin": 1234, "other.txt": 2} {
+		if entry, err := fs.Lookup(name); err != nil {
+			t.Fatal(err)
+		} else if entry.Raw().FileSize() != expected {
+			t.Errorf("%s: expected size %d but got %d", name, expected, entry.Raw().FileSize())
+		}
+	}
+}
+
+func TestFileWritesSetArchive(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2016, 1, 2, 3, 4, 6, 0, time.UTC)
+	modified := time.Date(2017, 5, 6, 7, 8, 10, 0, time.UTC)
+	fs.SetClock(func() time.Time {
+		return modified
+	})
+
+	for _, op := range []struct {
+		name string
+		fn   func(f *File) error
+		size int64
+	}{
+		{"WriteAt", func(f *File) error {
+			_, err := f.WriteAt([]byte("hello"), 1)
+			return err
+		}, 6},
+		{"Truncate", func(f *File) error {
+			return f.Truncate(1, true)
+		}, 1},
+		{"TruncateGrow", func(f *File) error {
+			return f.Truncate(int64(fs.ClusterSize())*3, false)
+		}, int64(fs.ClusterSize()) * 3},
+		{"TruncateEmpty", func(f *File) error {
+			return f.Truncate(0, false)
+		}, 0},
+		{"ReadFrom", func(f *File) error {
+			_, err := f.ReadFrom(bytes.NewReader([]byte("hello world")))
+			return err
+		}, 11},
+	} {
+		name := op.name + ".txt"
+		_, err = CreateFile(NewDir(fs.RootDir()), name, bytes.NewReader([]byte("hi")), created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.ClearArchive(name); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := op.fn(file); err != nil {
+			t.Fatal(op.name, err)
+		}
+		entry, err := fs.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := entry.Raw()
+		if raw.Attr()&Archive == 0 {
+			t.Errorf("%s: archive attribute was not set", op.name)
+		}
+		if raw.WrtDate() != fatDate(modified) || raw.WrtTime() != fatTime(modified) {
+			t.Errorf("%s: write timestamp was not updated", op.name)
+		}
+		if int64(raw.FileSize()) != op.size {
+			t.Errorf("%s: expected size %d but got %d", op.name, op.size, raw.FileSize())
+		}
+		if raw.FirstCluster() != file.Chain.FirstCluster() {
+			t.Errorf("%s: expected first cluster %d but got %d", op.name,
+				file.Chain.FirstCluster(), raw.FirstCluster())
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package fatfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// NamedContent is a file to be created by BatchCreate.
+type NamedContent struct {
+	Name string
+	Data []byte
+
+	// Date is the file's timestamp.
+	// If it is the zero time, the FS clock is used.
+	Date time.Time
+}
+
+// BatchCreate creates many regular files in a directory.
+//
+// The result is the same as calling CreateFile for each
+// file in order, but the work is batched: the directory is
+// read once, the clusters for all of the files (and for
+// extending the directory) are allocated in one FAT pass,
+// file data is written cluster by cluster in allocation
+// order, and each directory sector is written once.
+//
+// As in CreateFile, a short name which is already in use
+// is given a numeric tail.
+//
+// Every name is checked before anything is written, so if
+// a name is invalid or already in use, including by an
+// earlier file in the batch, no files are created.
+//
+// File data is written before the FAT, and the new
+// directory entries are written last, so an interrupted
+// batch leaves at most some lost clusters.
+func (f *FS) BatchCreate(dir *Chain, files []NamedContent) (err error) {
+	defer essentials.AddCtxTo("BatchCreate", &err)
+	if len(files) == 0 {
+		return nil
+	}
+
+	d := NewDir(dir)
+	listing, err := d.ReadDir()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	shortNames := shortNamesOf(listing)
+	markUsed := func(entry DirEntry) {
+		used[strings.ToLower(entry.Name())] = true
+		used[strings.ToLower(UnformatName(string(entry.Raw().Name())))] = true
+	}
+	for _, entry := range listing {
+		if !entry.Raw().IsDotPointer() {
+			markUsed(entry)
+		}
+	}
+
+	clusterSize := f.ClusterSize()
+	entries := make([]DirEntry, len(files))
+	numClusters := make([]int, len(files))
+	totalClusters := 0
+	for i, file := range files {
+		if err := ValidateName(file.Name); err != nil {
+			return err
+		}
+		if used[strings.ToLower(file.Name)] {
+			return essentials.AddCtx(file.Name, os.ErrExist)
+		}
+		if int64(len(file.Data)) >= 1<<32 {
+			return essentials.AddCtx(file.Name, errors.New("file is too large"))
+		}
+		date := file.Date
+		if date.IsZero() {
+			date = f.now()
+		}
+		entry, err := shortNames.unique(file.Name,
+			NewDirEntry(file.Name, 0, uint32(len(file.Data)), date, false))
+		if err != nil {
+			return essentials.AddCtx(file.Name, err)
+		}
+		entry.Raw().SetAttr(Archive)
+		if len(entry)*32 > clusterSize {
+			return essentials.AddCtx(file.Name,
+				errors.New("entry is too large to fit into a cluster"))
+		}
+		markUsed(entry)
+		entries[i] = entry
+		numClusters[i] = (len(file.Data) + clusterSize - 1) / clusterSize
+		totalClusters += numClusters[i]
+	}
+
+	// Lay out the new entries after the last entry in the
+	// final cluster of the directory, as AddEntry does.
+	if _, err := dir.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	lastCluster, err := dir.ReadCluster()
+	if err != nil {
+		return err
+	}
+	startOffset := len(lastCluster)
+	for startOffset > 0 && lastCluster[startOffset-32] == 0 {
+		startOffset -= 32
+	}
+	type entryPos struct {
+		cluster int
+		offset  int
+	}
+	positions := make([]entryPos, len(entries))
+	pos := entryPos{offset: startOffset}
+	for i, entry := range entries {
+		if pos.offset+len(entry)*32 > clusterSize {
+			pos = entryPos{cluster: pos.cluster + 1}
+		}
+		positions[i] = pos
+		pos.offset += len(entry) * 32
+	}
+	numDirClusters := pos.cluster
+
+	free, err := f.findFreeClusters(totalClusters + numDirClusters)
+	if err != nil {
+		return err
+	}
+	fatEntries := map[uint32]uint32{}
+	fileClusters := free[:totalClusters]
+	dirClusters := free[totalClusters:]
+	for i, entry := range entries {
+		list := fileClusters[:numClusters[i]]
+		fileClusters = fileClusters[numClusters[i]:]
+		if len(list) > 0 {
+			entry.Raw().SetFirstCluster(list[0])
+			for j, cluster := range list[1:] {
+				fatEntries[list[j]] = cluster
+			}
+			fatEntries[list[len(list)-1]] = EOF
+		}
+	}
+	if len(dirClusters) > 0 {
+		fatEntries[dir.cluster] = dirClusters[0]
+		for j, cluster := range dirClusters[1:] {
+			fatEntries[dirClusters[j]] = cluster
+		}
+		fatEntries[dirClusters[len(dirClusters)-1]] = EOF
+	}
+
+	dirData := [][]byte{lastCluster}
+	for range dirClusters {
+		dirData = append(dirData, make([]byte, clusterSize))
+	}
+	for i, entry := range entries {
+		p := positions[i]
+		if i+1 == len(entries) || positions[i+1].cluster != p.cluster {
+			// Pad the rest of a non-final cluster so that it
+			// does not end the directory.
+			if p.cluster < numDirClusters {
+				markDeleted(dirData[p.cluster][p.offset+len(entry)*32:])
+			}
+		}
+		for j, raw := range entry {
+			copy(dirData[p.cluster][p.offset+j*32:], raw[:])
+		}
+	}
+	if positions[0].cluster > 0 {
+		markDeleted(lastCluster[startOffset:])
+	}
+
+	lastSector := int(f.BootSector.SecPerClus()) - 1
+	buf := make([]byte, clusterSize)
+	for i, file := range files {
+		chain := NewChain(f, entries[i].Raw().FirstCluster())
+		for offset := 0; offset < len(file.Data); offset += clusterSize {
+			for j := range buf {
+				buf[j] = 0
+			}
+			copy(buf, file.Data[offset:])
+			if err := chain.writeSectors(buf, 0, lastSector); err != nil {
+				return err
+			}
+			chain.cluster = fatEntries[chain.cluster]
+		}
+	}
+	for i, cluster := range dirClusters {
+		chain := NewChain(f, cluster)
+		if err := chain.writeSectors(dirData[i+1], 0, lastSector); err != nil {
+			return err
+		}
+	}
+	if err := f.writeFATEntries(fatEntries); err != nil {
+		return err
+	}
+	if len(free) > 0 {
+		f.allocCursor = free[len(free)-1] + 1
+	}
+	dir.cache = nil
+
+	if startOffset < clusterSize {
+		endOffset := clusterSize
+		if numDirClusters == 0 {
+			endOffset = pos.offset
+		}
+		err := dir.writeSectors(lastCluster, startOffset/SectorSize, (endOffset-1)/SectorSize)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dir.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,153 @@
+package fatfs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBatchCreate(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("configs", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(dir, "existing.txt", bytes.NewReader([]byte("hi")),
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []NamedContent
+	for i := 0; i < 300; i++ {
+		data := make([]byte, rand.Intn(fs.ClusterSize()*3))
+		rand.Read(data)
+		files = append(files, NamedContent{
+			Name: fmt.Sprintf("a long config name %d.conf", i),
+			Data: data,
+		})
+	}
+	files = append(files, NamedContent{Name: "EMPTY.TXT"})
+	if err := fs.BatchCreate(dir.Chain, files); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range append(files, NamedContent{Name: "existing.txt", Data: []byte("hi")}) {
+		data, err := fs.ReadFile("configs/" + file.Name)
+		if err != nil {
+			t.Fatalf("%s: %v", file.Name, err)
+		}
+		if !bytes.Equal(data, file.Data) {
+			t.Fatalf("%s: unexpected contents", file.Name)
+		}
+	}
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != len(files)+3 {
+		t.Errorf("expected %d entries but got %d", len(files)+3, len(listing))
+	}
+	shortNames := map[string]bool{}
+	for _, entry := range listing {
+		short := string(entry.Raw().Name())
+		if shortNames[short] {
+			t.Errorf("duplicate short name %q", short)
+		}
+		shortNames[short] = true
+	}
+	if chains, err := fs.AllocatedChains(); err != nil {
+		t.Fatal(err)
+	} else if len(chains) != 3+len(files)-1 {
+		t.Errorf("unexpected number of chains: %d", len(chains))
+	}
+
+	if _, err := CreateFile(dir, "after.txt", bytes.NewReader([]byte("after")),
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile("configs/after.txt"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "after" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+
+	for _, batch := range [][]NamedContent{
+		{{Name: "new.txt"}, {Name: "EXISTING.TXT"}},
+		{{Name: "new.txt"}, {Name: "New.Txt"}},
+		{{Name: "new.txt"}, {Name: "bad/name"}},
+	} {
+		if err := fs.BatchCreate(dir.Chain, batch); err == nil {
+			t.Errorf("%v: expected error", batch)
+		}
+		if ok, err := fs.Exists("configs/new.txt"); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Errorf("%v: file was created", batch)
+		}
+	}
+}
+
+func BenchmarkBatchCreate(b *testing.B) {
+	var files []NamedContent
+	for i := 0; i < 1000; i++ {
+		files = append(files, NamedContent{
+			Name: fmt.Sprintf("config%d.conf", i),
+			Data: []byte("key = value\n"),
+		})
+	}
+	b.Run("CreateFile", func(b *testing.B) {
+		benchmarkCreateMany(b, func(fs *FS, dir *Dir) error {
+			for _, file := range files {
+				_, err := CreateFile(dir, file.Name, bytes.NewReader(file.Data), time.Time{})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	b.Run("BatchCreate", func(b *testing.B) {
+		benchmarkCreateMany(b, func(fs *FS, dir *Dir) error {
+			return fs.BatchCreate(dir.Chain, files)
+		})
+	})
+}
+
+func benchmarkCreateMany(b *testing.B, create func(fs *FS, dir *Dir) error) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var accesses int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := Mkdir(NewDir(fs.RootDir()), "configs", time.Time{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		fs.OnSectorRead = func(sector uint32) {
+			accesses++
+		}
+		fs.OnSectorWrite = fs.OnSectorRead
+		b.StartTimer()
+		if err := create(fs, dir); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		fs.OnSectorRead = nil
+		fs.OnSectorWrite = nil
+		if err := Remove(NewDir(fs.RootDir()), "configs"); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(accesses)/float64(b.N), "sectors/op")
+}
@@ -2,15 +2,22 @@ package fatfs
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
 	"strings"
 )
 
 // NewBootSector32 creates a BootSector for a new FAT32
 // file-system.
+//
+// The volume label may contain at most 11 printable ASCII
+// characters, and it is converted to upper-case.
+// Characters which are not allowed in short names, such
+// as '?' or '/', are rejected.
 func NewBootSector32(numSectors uint32, volumeLabel string) (*BootSector, error) {
-	for len(volumeLabel) < 11 {
-		volumeLabel += " "
+	volumeLabel, err := formatVolumeLabel(volumeLabel)
+	if err != nil {
+		return nil, err
 	}
 	if numSectors < 8*65525 {
 		return nil, errors.New("volume is too small")
@@ -41,13 +48,29 @@ func NewBootSector32(numSectors uint32, volumeLabel string) (*BootSector, error)
 	res.SetDrvNum(0x80)
 	res.SetBootSig(0x29)
 	res.SetVolID(uint32(rand.Int31()))
-	copy(res.VolLab(), []byte(strings.ToUpper(volumeLabel)))
+	copy(res.VolLab(), []byte(volumeLabel))
 	copy(res.FilSysType(), []byte("FAT32   "))
 	res[510] = 0x55
 	res[511] = 0xaa
 	return res, nil
 }
 
+// formatVolumeLabel validates a volume label and pads it
+// to the 11-byte on-disk form.
+func formatVolumeLabel(label string) (string, error) {
+	for _, ch := range label {
+		if ch < 0x20 || ch > 0x7e {
+			return "", fmt.Errorf("volume label has non-ASCII character %q", ch)
+		} else if strings.ContainsRune(`"*+,./:;<=>?[\]|`, ch) {
+			return "", fmt.Errorf("volume label has invalid character %q", ch)
+		}
+	}
+	if len(label) > 11 {
+		return "", errors.New("volume label is longer than 11 characters")
+	}
+	return spacePad(strings.ToUpper(label), 11), nil
+}
+
 func ceilDiv(num, denom uint32) uint32 {
 	if num%denom != 0 {
 		return num/denom + 1
@@ -55,3 +78,119 @@ func ceilDiv(num, denom uint32) uint32 {
 		return num / denom
 	}
 }
+
+// BPBFields holds every field of a FAT32 boot sector's
+// BIOS parameter block and extended BIOS parameter block.
+//
+// Field names match the accessor methods of BootSector.
+type BPBFields struct {
+	BootJump    [3]byte
+	OEMName     [8]byte
+	BytesPerSec uint16
+	SecPerClus  uint8
+	RsvdSecCnt  uint16
+	NumFATs     uint8
+	RootEntCnt  uint16
+	TotSec16    uint16
+	Media       uint8
+	FatSz16     uint16
+	SecPerTrk   uint16
+	NumHeads    uint16
+	HiddSec     uint32
+	TotSec32    uint32
+	FatSz32     uint32
+	ExtFlags    uint16
+	FSVer       uint16
+	RootClus    uint32
+	FSInfo      uint16
+	BkBootSec   uint16
+	Reserved    [12]byte
+	DrvNum      uint8
+	Reserved1   uint8
+	BootSig     uint8
+	VolID       uint32
+	VolLab      [11]byte
+	FilSysType  [8]byte
+}
+
+// TotSec gets the total number of sectors in the volume.
+//
+// FAT32 volumes normally store the count in TotSec32, but
+// some tools use TotSec16 for smaller volumes and leave
+// TotSec32 as zero.
+// TotSec32 takes precedence, and TotSec16 is only used if
+// TotSec32 is zero.
+func (b *BootSector) TotSec() uint32 {
+	if n := b.TotSec32(); n != 0 {
+		return n
+	}
+	return uint32(b.TotSec16())
+}
+
+// Fields decodes all of the boot sector's fields.
+func (b *BootSector) Fields() BPBFields {
+	res := BPBFields{
+		BytesPerSec: b.BytesPerSec(),
+		SecPerClus:  b.SecPerClus(),
+		RsvdSecCnt:  b.RsvdSecCnt(),
+		NumFATs:     b.NumFATs(),
+		RootEntCnt:  b.RootEntCnt(),
+		TotSec16:    b.TotSec16(),
+		Media:       b.Media(),
+		FatSz16:     b.FatSz16(),
+		SecPerTrk:   b.SecPerTrk(),
+		NumHeads:    b.NumHeads(),
+		HiddSec:     b.HiddSec(),
+		TotSec32:    b.TotSec32(),
+		FatSz32:     b.FatSz32(),
+		ExtFlags:    b.ExtFlags(),
+		FSVer:       b.FSVer(),
+		RootClus:    b.RootClus(),
+		FSInfo:      b.FSInfo(),
+		BkBootSec:   b.BkBootSec(),
+		DrvNum:      b.DrvNum(),
+		Reserved1:   b.Reserved1(),
+		BootSig:     b.BootSig(),
+		VolID:       b.VolID(),
+	}
+	copy(res.BootJump[:], b.BootJump())
+	copy(res.OEMName[:], b.OEMName())
+	copy(res.Reserved[:], b.Reserved())
+	copy(res.VolLab[:], b.VolLab())
+	copy(res.FilSysType[:], b.FilSysType())
+	return res
+}
+
+// SetFields encodes all of the fields into the boot
+// sector.
+// Bytes outside of the BPB, such as the boot code and
+// signature, are left unchanged.
+func (b *BootSector) SetFields(f BPBFields) {
+	copy(b.BootJump(), f.BootJump[:])
+	copy(b.OEMName(), f.OEMName[:])
+	b.SetBytesPerSec(f.BytesPerSec)
+	b.SetSecPerClus(f.SecPerClus)
+	b.SetRsvdSecCnt(f.RsvdSecCnt)
+	b.SetNumFATs(f.NumFATs)
+	b.SetRootEntCnt(f.RootEntCnt)
+	b.SetTotSec16(f.TotSec16)
+	b.SetMedia(f.Media)
+	b.SetFatSz16(f.FatSz16)
+	b.SetSecPerTrk(f.SecPerTrk)
+	b.SetNumHeads(f.NumHeads)
+	b.SetHiddSec(f.HiddSec)
+	b.SetTotSec32(f.TotSec32)
+	b.SetFatSz32(f.FatSz32)
+	b.SetExtFlags(f.ExtFlags)
+	b.SetFSVer(f.FSVer)
+	b.SetRootClus(f.RootClus)
+	b.SetFSInfo(f.FSInfo)
+	b.SetBkBootSec(f.BkBootSec)
+	copy(b.Reserved(), f.Reserved[:])
+	b.SetDrvNum(f.DrvNum)
+	b.SetReserved1(f.Reserved1)
+	b.SetBootSig(f.BootSig)
+	b.SetVolID(f.VolID)
+	copy(b.VolLab(), f.VolLab[:])
+	copy(b.FilSysType(), f.FilSysType[:])
+}
@@ -0,0 +1,35 @@
+package fatfs
+
+import "testing"
+
+func TestBootSectorFields(t *testing.T) {
+	bs, err := NewBootSector32(8*65525*2, "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := bs.Fields()
+	if fields.TotSec32 != 8*65525*2 || fields.SecPerClus != 8 || fields.RootClus != 2 {
+		t.Errorf("unexpected fields: %+v", fields)
+	}
+	if string(fields.VolLab[:]) != "FOO        " || string(fields.FilSysType[:]) != "FAT32   " {
+		t.Errorf("unexpected strings: %q, %q", fields.VolLab, fields.FilSysType)
+	}
+
+	var copied BootSector
+	copied[510] = 0x55
+	copied[511] = 0xaa
+	copied.SetFields(fields)
+	if copied != *bs {
+		t.Error("SetFields did not reproduce the boot sector")
+	}
+
+	fields.HiddSec = 0x12345678
+	fields.OEMName = [8]byte{'E', 'D', 'I', 'T', 'O', 'R', ' ', ' '}
+	copied.SetFields(fields)
+	if copied.HiddSec() != 0x12345678 || string(copied.OEMName()) != "EDITOR  " {
+		t.Error("fields were not updated")
+	}
+	if copied.Fields() != fields {
+		t.Error("fields did not round trip")
+	}
+}
@@ -2,6 +2,7 @@ package fatfs
 
 import (
 	"errors"
+	"hash/crc32"
 	"io"
 
 	"github.com/unixpickle/essentials"
@@ -9,6 +10,38 @@ import (
 
 const EOF = 0x0FFFFFF8
 
+// badCluster is the FAT entry for a defective cluster.
+const badCluster = 0x0FFFFFF7
+
+// ErrInvalidCluster is returned when a Chain points to a
+// cluster outside of the data region, i.e. a cluster
+// which is not in the range [2, NumClusters()).
+var ErrInvalidCluster = errors.New("invalid cluster")
+
+// ErrClusterBeyondDevice is returned when a cluster is in
+// the data region according to the boot sector, but some
+// of its sectors are past the end of the device.
+var ErrClusterBeyondDevice = errors.New("cluster is beyond the end of the device")
+
+// ErrClusterOutOfRange is returned when a Chain reads or
+// writes a cluster outside of the data region.
+// It wraps ErrInvalidCluster, so errors.Is matches both.
+var ErrClusterOutOfRange error = clusterRangeError{}
+
+type clusterRangeError struct{}
+
+func (clusterRangeError) Error() string {
+	return "cluster is out of range"
+}
+
+func (clusterRangeError) Unwrap() error {
+	return ErrInvalidCluster
+}
+
+// ErrTooLarge is returned when a chain holds more data
+// than the caller allowed.
+var ErrTooLarge = errors.New("chain is too large")
+
 // A Chain is a readable, writeable, expandable piece of
 // data on a file-system. It is stored as a sequence of
 // clusters, joined together by the FAT.
@@ -16,17 +49,40 @@ const EOF = 0x0FFFFFF8
 // A Chain behaves like a tape. At any point, it is
 // pointing to a cluster, and it may be moved back and
 // forth, expanded, etc.
+//
+// A Chain whose first cluster is 0 is empty, as is the
+// case for empty files. An empty Chain has no clusters to
+// read or write until it is extended.
 type Chain struct {
 	fs      *FS
 	cluster uint32
 	prev    []uint32
+
+	// cache is the full list of clusters, or nil if the
+	// chain has not been cached.
+	cache []uint32
 }
 
 // NewChain creates a Chain starting at a cluster.
+// If start is 0, the Chain is empty.
 func NewChain(fs *FS, start uint32) *Chain {
 	return &Chain{fs: fs, cluster: start}
 }
 
+// NewChainAlloc allocates a cluster with FS.Alloc and
+// creates a single-cluster Chain starting at it.
+//
+// The cluster's contents are not changed.
+// The cluster can be recorded in a directory entry using
+// the Chain's FirstCluster.
+func (f *FS) NewChainAlloc() (*Chain, error) {
+	cluster, err := f.Alloc()
+	if err != nil {
+		return nil, essentials.AddCtx("NewChainAlloc", err)
+	}
+	return NewChain(f, cluster), nil
+}
+
 // RootDirChain gets a Chain for the root directory.
 func RootDirChain(fs *FS) *Chain {
 	return NewChain(fs, fs.BootSector.RootClus())
@@ -48,35 +104,171 @@ func (c *Chain) FirstCluster() uint32 {
 
 // ReadCluster reads the current cluster of the Chain.
 func (c *Chain) ReadCluster() ([]byte, error) {
-	res := make([]byte, 0, c.fs.ClusterSize())
-	offset := c.clusterSector()
+	res := make([]byte, c.fs.ClusterSize())
+	if err := c.readClusterInto(res); err != nil {
+		addErrorOp("ReadCluster", &err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// readClusterInto reads the current cluster into buf,
+// which must be one cluster long.
+//
+// Device errors are returned as an *FSError without an
+// operation.
+func (c *Chain) readClusterInto(buf []byte) error {
+	offset, err := c.clusterSector()
+	if err != nil {
+		return err
+	}
 	for i := 0; i < int(c.fs.BootSector.SecPerClus()); i++ {
-		sector, err := c.fs.Device.ReadSector(offset + uint32(i))
+		sector, err := c.fs.readSector(offset + uint32(i))
 		if err != nil {
-			return nil, essentials.AddCtx("ReadCluster", err)
+			return &FSError{Cluster: c.cluster, Sector: offset + uint32(i), Err: err}
 		}
-		res = append(res, sector[:]...)
+		copy(buf[i*SectorSize:], sector[:])
 	}
-	return res, nil
+	return nil
 }
 
 // WriteCluster writes the current cluster of the chain.
 func (c *Chain) WriteCluster(data []byte) (err error) {
-	defer essentials.AddCtxTo("WriteCluster", &err)
+	defer addErrorOp("WriteCluster", &err)
 	if len(data) != c.fs.ClusterSize() {
 		return errors.New("incorrect cluster size")
 	}
-	offset := c.clusterSector()
-	var chunk Sector
-	for i := 0; i < int(c.fs.BootSector.SecPerClus()); i++ {
-		copy(chunk[:], data[i*SectorSize:])
-		if err := c.fs.Device.WriteSector(offset+uint32(i), &chunk); err != nil {
-			return err
+	return c.writeSectors(data, 0, int(c.fs.BootSector.SecPerClus())-1)
+}
+
+// WriteClusterZero fills the current cluster of the Chain
+// with zeros.
+//
+// If the device is a ZeroReporter and reports that the
+// cluster is already zero, nothing is written.
+// Otherwise, every sector is written from a single shared
+// zero sector.
+func (c *Chain) WriteClusterZero() (err error) {
+	defer addErrorOp("WriteClusterZero", &err)
+	first, err := c.clusterSector()
+	if err != nil {
+		return err
+	}
+	count := uint32(c.fs.BootSector.SecPerClus())
+	if zero, err := c.fs.sectorsZero(first, count); err != nil {
+		return err
+	} else if zero {
+		return nil
+	}
+	var zero Sector
+	for i := uint32(0); i < count; i++ {
+		if err := c.fs.writeSector(first+i, &zero); err != nil {
+			return &FSError{Cluster: c.cluster, Sector: first + i, Err: err}
 		}
 	}
 	return nil
 }
 
+// WriteClusterFrom reads up to one cluster of data from r
+// and writes it to the current cluster of the chain,
+// padding it with zeros if r ends early.
+//
+// The chain is not extended or advanced, so callers can
+// stream data a cluster at a time with Extend or Seek.
+//
+// Sets done to true if r ended before a full cluster was
+// read.
+// If r had no data left at all, nothing is written.
+func (c *Chain) WriteClusterFrom(r io.Reader) (done bool, err error) {
+	defer addErrorOp("WriteClusterFrom", &err)
+	data := make([]byte, c.fs.ClusterSize())
+	if _, err := io.ReadFull(r, data); err == io.EOF {
+		return true, nil
+	} else if err == io.ErrUnexpectedEOF {
+		done = true
+	} else if err != nil {
+		return false, err
+	}
+	return done, c.writeSectors(data, 0, int(c.fs.BootSector.SecPerClus())-1)
+}
+
+// ReadClusterAt reads the cluster at a cluster offset from
+// the start of the chain.
+// The position in the chain is preserved.
+func (c *Chain) ReadClusterAt(offset int64) (data []byte, err error) {
+	defer essentials.AddCtxTo("ReadClusterAt", &err)
+	err = c.atOffset(offset, func() error {
+		data, err = c.ReadCluster()
+		return err
+	})
+	return
+}
+
+// ReadTail reads the end of a file whose chain this is,
+// given the file's logical size.
+//
+// The cluster holding the last byte of the file is read,
+// and only the bytes within the file are returned: size
+// modulo the cluster size, or the whole cluster if size is
+// a multiple of the cluster size.
+// If size is 0, the result is empty and nothing is read.
+// The position in the chain is preserved.
+func (c *Chain) ReadTail(size int64) (data []byte, err error) {
+	defer essentials.AddCtxTo("ReadTail", &err)
+	if size < 0 {
+		return nil, errors.New("negative size")
+	} else if size == 0 {
+		return []byte{}, nil
+	}
+	clusterSize := int64(c.fs.ClusterSize())
+	err = c.atOffset((size-1)/clusterSize, func() error {
+		data, err = c.ReadCluster()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data[:(size-1)%clusterSize+1], nil
+}
+
+// WriteClusterAt writes the cluster at a cluster offset
+// from the start of the chain.
+// The position in the chain is preserved.
+//
+// The offset must be within the chain; the chain is never
+// extended.
+func (c *Chain) WriteClusterAt(offset int64, data []byte) (err error) {
+	defer essentials.AddCtxTo("WriteClusterAt", &err)
+	return c.atOffset(offset, func() error {
+		return c.WriteCluster(data)
+	})
+}
+
+// atOffset runs f while the chain is positioned at the
+// given cluster offset, and then restores the position.
+func (c *Chain) atOffset(offset int64, f func() error) error {
+	if offset < 0 {
+		return errors.New("negative offset")
+	}
+	oldOffset, err := c.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if newOffset, err := c.Seek(offset, io.SeekStart); err != nil {
+		return err
+	} else if newOffset != offset {
+		if _, err := c.Seek(oldOffset, io.SeekStart); err != nil {
+			return err
+		}
+		return errors.New("offset past end of chain")
+	}
+	err = f()
+	if _, seekErr := c.Seek(oldOffset, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return err
+}
+
 // Seek moves around within the chain by a certain number
 // of clusters (not bytes).
 //
@@ -104,18 +296,8 @@ func (c *Chain) Seek(offset int64, whence int) (int64, error) {
 			c.prev = c.prev[:newPrevLen]
 			return int64(len(c.prev)), nil
 		}
-		for i := int64(0); i < offset; i++ {
-			next, err := c.fs.ReadFAT(c.cluster)
-			if err != nil {
-				return 0, essentials.AddCtx("Seek", err)
-			}
-			if next >= EOF {
-				return int64(len(c.prev)), nil
-			}
-			c.prev = append(c.prev, c.cluster)
-			c.cluster = next
-		}
-		return int64(len(c.prev)), nil
+		newOffset, err := c.advance(offset, newFATReader(c.fs))
+		return newOffset, essentials.AddCtx("Seek", err)
 	} else if whence == io.SeekEnd {
 		if _, err := c.Seek(1<<32, io.SeekCurrent); err != nil {
 			return 0, err
@@ -125,17 +307,301 @@ func (c *Chain) Seek(offset int64, whence int) (int64, error) {
 	return 0, errors.New("Seek: unknown whence")
 }
 
+// advance moves forward by up to offset clusters, reading
+// FAT entries through r.
+// It returns the new cluster offset.
+func (c *Chain) advance(offset int64, r *fatReader) (int64, error) {
+	if c.cache != nil {
+		idx := int64(len(c.prev)) + offset
+		if idx >= int64(len(c.cache)) {
+			idx = int64(len(c.cache)) - 1
+		}
+		c.prev = c.cache[:idx:idx]
+		c.cluster = c.cache[idx]
+		return idx, nil
+	}
+	if c.cluster == 0 {
+		return 0, nil
+	}
+	for i := int64(0); i < offset; i++ {
+		next, err := r.Read(c.cluster)
+		if err != nil {
+			return 0, err
+		}
+		if next >= EOF {
+			return int64(len(c.prev)), nil
+		}
+		c.prev = append(c.prev, c.cluster)
+		c.cluster = next
+	}
+	return int64(len(c.prev)), nil
+}
+
+// PeekNext reads the FAT entry for the current cluster
+// without moving the chain.
+//
+// If the current cluster is the last one, or the chain is
+// empty, isEOF is true and cluster is 0.
+// Otherwise, cluster is the raw FAT entry, which is not
+// validated.
+func (c *Chain) PeekNext() (cluster uint32, isEOF bool, err error) {
+	if c.cluster == 0 {
+		return 0, true, nil
+	}
+	next, err := c.fs.ReadFAT(c.cluster)
+	if err != nil {
+		return 0, false, essentials.AddCtx("PeekNext", err)
+	}
+	if next >= EOF {
+		return 0, true, nil
+	}
+	return next, false, nil
+}
+
+// LastCluster gets the final cluster of the chain, which
+// is marked as EOF in the FAT.
+// The position in the chain is preserved.
+//
+// For a single-cluster chain, this is the first cluster.
+// For an empty chain, it is 0.
+func (c *Chain) LastCluster() (cluster uint32, err error) {
+	defer essentials.AddCtxTo("LastCluster", &err)
+	offset, err := c.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	cluster = c.cluster
+	if _, err := c.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return cluster, nil
+}
+
+// Cache reads the FAT entries for the entire chain and
+// stores the list of clusters, so that subsequent seeks do
+// not need to access the FAT.
+// The position in the chain is preserved.
+//
+// The cache is dropped when the chain is modified with
+// Extend, Truncate, Free, or SetClusters.
+// It becomes stale if the chain's FAT entries are changed
+// in some other way, for example through a different
+// Chain for the same clusters.
+func (c *Chain) Cache() (err error) {
+	defer essentials.AddCtxTo("Cache", &err)
+	offset, err := c.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	c.cache = append(append([]uint32{}, c.prev...), c.cluster)
+	_, err = c.Seek(offset, io.SeekStart)
+	return err
+}
+
+// AppendClusters appends the cluster numbers of the chain
+// to dst, reusing its capacity, and returns the result.
+//
+// The position in the chain is not changed.
+// If the chain is longer than the number of clusters in
+// the file-system, it must be cyclic, and an error is
+// returned.
+func (c *Chain) AppendClusters(dst []uint32) (res []uint32, err error) {
+	defer essentials.AddCtxTo("AppendClusters", &err)
+	if c.cache != nil {
+		return append(dst, c.cache...), nil
+	}
+	cluster := c.cluster
+	if len(c.prev) > 0 {
+		cluster = c.prev[0]
+	}
+	if cluster == 0 {
+		return dst, nil
+	}
+	r := newFATReader(c.fs)
+	for i := uint32(0); i < c.fs.NumClusters(); i++ {
+		dst = append(dst, cluster)
+		next, err := r.Read(cluster)
+		if err != nil {
+			return dst, err
+		}
+		if next >= EOF {
+			return dst, nil
+		}
+		cluster = next
+	}
+	return dst, errors.New("cyclic chain")
+}
+
+// AllocatedBytes gets the amount of space the chain takes
+// up on the device, i.e. the number of clusters times the
+// cluster size.
+//
+// For a file, this is its size on disk, which includes the
+// unused part of its final cluster.
+// The position in the chain is not changed.
+func (c *Chain) AllocatedBytes() (n int64, err error) {
+	defer essentials.AddCtxTo("AllocatedBytes", &err)
+	clusterSize := int64(c.fs.ClusterSize())
+	if c.cache != nil {
+		return int64(len(c.cache)) * clusterSize, nil
+	}
+	cluster := c.FirstCluster()
+	if cluster == 0 {
+		return 0, nil
+	}
+	r := newFATReader(c.fs)
+	for i := uint32(0); i < c.fs.NumClusters(); i++ {
+		n += clusterSize
+		next, err := r.Read(cluster)
+		if err != nil {
+			return n, err
+		}
+		if next >= EOF {
+			return n, nil
+		}
+		cluster = next
+	}
+	return n, errors.New("cyclic chain")
+}
+
+// ClusterForOffset finds the cluster which holds a byte
+// offset in the chain starting at first, along with the
+// offset of the byte within that cluster.
+//
+// It is an error if the offset is past the end of the
+// chain, or if the chain loops back on itself before
+// reaching the offset.
+func (f *FS) ClusterForOffset(first uint32, byteOff int64) (cluster uint32, within int, err error) {
+	defer essentials.AddCtxTo("ClusterForOffset", &err)
+	if byteOff < 0 {
+		return 0, 0, errors.New("negative offset")
+	}
+	clusterSize := int64(f.ClusterSize())
+	index := byteOff / clusterSize
+	visited := map[uint32]bool{}
+	r := newFATReader(f)
+	cluster = first
+	for i := int64(0); ; i++ {
+		if (i == 0 && cluster == 0) || cluster >= EOF {
+			return 0, 0, errors.New("offset is past the end of the chain")
+		} else if cluster < 2 || cluster >= f.NumClusters() {
+			return 0, 0, ErrInvalidCluster
+		} else if visited[cluster] {
+			return 0, 0, errors.New("cyclic chain")
+		}
+		if i == index {
+			return cluster, int(byteOff % clusterSize), nil
+		}
+		visited[cluster] = true
+		cluster, err = r.Read(cluster)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// ChainsOverlap checks if two chains share any clusters.
+//
+// Each chain is walked from its first cluster, and a walk
+// stops if it reaches a cluster it has already visited, so
+// cyclic chains are handled.
+// The second walk stops at the first shared cluster.
+// Chains on different file-systems never overlap.
+func ChainsOverlap(a, b *Chain) (overlap bool, err error) {
+	defer essentials.AddCtxTo("ChainsOverlap", &err)
+	if a.fs != b.fs {
+		return false, nil
+	}
+	inA := map[uint32]bool{}
+	err = a.walkClusters(func(cluster uint32) bool {
+		inA[cluster] = true
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	err = b.walkClusters(func(cluster uint32) bool {
+		overlap = inA[cluster]
+		return !overlap
+	})
+	return overlap, err
+}
+
+// walkClusters calls f with each cluster of the chain,
+// starting from the first cluster, until f returns false,
+// the chain ends, or a cluster is repeated.
+func (c *Chain) walkClusters(f func(cluster uint32) bool) error {
+	visited := map[uint32]bool{}
+	r := newFATReader(c.fs)
+	cluster := c.FirstCluster()
+	for cluster != 0 && !visited[cluster] {
+		if cluster < 2 || cluster >= c.fs.NumClusters() {
+			return ErrInvalidCluster
+		}
+		visited[cluster] = true
+		if !f(cluster) {
+			return nil
+		}
+		next, err := r.Read(cluster)
+		if err != nil {
+			return err
+		}
+		if next >= EOF {
+			return nil
+		}
+		cluster = next
+	}
+	return nil
+}
+
 // Extend adds a new cluster to the end of the chain and
 // seeks to it.
+//
+// If the chain is empty, the new cluster becomes its first
+// cluster.
 func (c *Chain) Extend() (err error) {
-	defer essentials.AddCtxTo("Extend", &err)
+	return essentials.AddCtx("Extend", c.extend(nil))
+}
+
+// ExtendWith is like Extend, but it also sets the contents
+// of the new cluster.
+//
+// The data is written before the new cluster is linked to
+// the end of the chain, so the chain never includes the
+// cluster before its contents are in place.
+func (c *Chain) ExtendWith(data []byte) (err error) {
+	defer essentials.AddCtxTo("ExtendWith", &err)
+	if len(data) != c.fs.ClusterSize() {
+		return errors.New("incorrect cluster size")
+	}
+	return c.extend(data)
+}
+
+func (c *Chain) extend(data []byte) error {
 	if _, err := c.Seek(0, io.SeekEnd); err != nil {
 		return err
 	}
+	c.cache = nil
 	cluster, err := c.fs.Alloc()
 	if err != nil {
 		return err
 	}
+	if data != nil {
+		if err := NewChain(c.fs, cluster).WriteCluster(data); err != nil {
+			c.fs.WriteFAT(cluster, 0)
+			return err
+		}
+	}
+	if c.cluster == 0 {
+		c.cluster = cluster
+		return nil
+	}
 	if err := c.fs.WriteFAT(c.cluster, cluster); err != nil {
 		c.fs.WriteFAT(cluster, 0)
 		return err
@@ -153,6 +619,7 @@ func (c *Chain) Truncate() (err error) {
 	if _, err := c.Seek(0, io.SeekEnd); err != nil {
 		return err
 	}
+	c.cache = nil
 	if len(c.prev) == 0 {
 		return errors.New("no clusters to remove")
 	}
@@ -168,6 +635,51 @@ func (c *Chain) Truncate() (err error) {
 	return nil
 }
 
+// Clear releases the data used by the Chain, leaving it
+// usable.
+//
+// If keepCluster is true, the chain is left with a single
+// zeroed cluster, allocating one if the chain was empty.
+// A non-empty chain keeps its first cluster, so directory
+// entries pointing to it remain valid.
+// If keepCluster is false, every cluster is freed and the
+// chain becomes empty, with a first cluster of 0.
+func (c *Chain) Clear(keepCluster bool) (err error) {
+	defer essentials.AddCtxTo("Clear", &err)
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.cache = nil
+	if c.cluster == 0 {
+		if !keepCluster {
+			return nil
+		}
+		if err := c.Extend(); err != nil {
+			return err
+		}
+	} else if !keepCluster {
+		if err := c.Free(); err != nil {
+			return err
+		}
+		c.cluster = 0
+		return nil
+	} else {
+		next, err := c.fs.ReadFAT(c.cluster)
+		if err != nil {
+			return err
+		}
+		if next < EOF {
+			if err := c.fs.WriteFAT(c.cluster, EOF); err != nil {
+				return err
+			}
+			if err := NewChain(c.fs, next).Free(); err != nil {
+				return err
+			}
+		}
+	}
+	return c.WriteCluster(make([]byte, c.fs.ClusterSize()))
+}
+
 // Free releases all of the data used by the Chain.
 // The Chain should not be used after calling Free.
 func (c *Chain) Free() (err error) {
@@ -175,14 +687,20 @@ func (c *Chain) Free() (err error) {
 	if _, err := c.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	for c.cluster < EOF {
-		next, err := c.fs.ReadFAT(c.cluster)
+	c.cache = nil
+	if c.cluster == 0 {
+		return nil
+	}
+	r := newFATReader(c.fs)
+	for c.cluster >= 2 && c.cluster < c.fs.NumClusters() {
+		next, err := r.Read(c.cluster)
 		if err != nil {
 			return err
 		}
 		if err := c.fs.WriteFAT(c.cluster, 0); err != nil {
 			return err
 		}
+		r.Set(c.cluster, 0)
 		c.cluster = next
 	}
 	return nil
@@ -193,29 +711,59 @@ func (c *Chain) Free() (err error) {
 //
 // Returns the number of bytes read from r before an error
 // was encountered.
+// The final cluster is padded with zeros, so n is the
+// exact amount of data, not a multiple of the cluster
+// size. See File.ReadFrom for writes that also track the
+// size of a file.
 func (c *Chain) ReadFrom(r io.Reader) (n int64, err error) {
-	defer essentials.AddCtxTo("WriteFrom", &err)
+	n, err = c.readFrom(r, 1)
+	return n, essentials.AddCtx("ReadFrom", err)
+}
+
+// ReadFromBuffered is like ReadFrom, but it reads up to
+// bufClusters clusters at a time from r.
+//
+// This reduces the number of reads performed on r, which
+// helps when r has a high per-call overhead.
+func (c *Chain) ReadFromBuffered(r io.Reader, bufClusters int) (n int64, err error) {
+	if bufClusters < 1 {
+		return 0, errors.New("ReadFromBuffered: buffer must hold at least one cluster")
+	}
+	n, err = c.readFrom(r, bufClusters)
+	return n, essentials.AddCtx("ReadFromBuffered", err)
+}
+
+func (c *Chain) readFrom(r io.Reader, bufClusters int) (n int64, err error) {
 	if _, err := c.Seek(0, io.SeekEnd); err != nil {
 		return 0, err
 	}
-	needsExtend := false
+	clusterSize := c.fs.ClusterSize()
+	buffer := make([]byte, clusterSize*bufClusters)
+	needsExtend := c.cluster == 0
 	for {
-		buffer := make([]byte, c.fs.ClusterSize())
 		m, readErr := io.ReadFull(r, buffer)
 		n += int64(m)
 		if readErr == io.EOF {
 			break
 		}
 
-		if needsExtend {
-			if err := c.Extend(); err != nil {
+		for i := 0; i < m; i += clusterSize {
+			cluster := buffer[i : i+clusterSize]
+			if i+clusterSize > m {
+				for j := m - i; j < clusterSize; j++ {
+					cluster[j] = 0
+				}
+			}
+			if needsExtend {
+				if err := c.Extend(); err != nil {
+					return n, err
+				}
+			}
+			needsExtend = true
+			if err := c.WriteCluster(cluster); err != nil {
 				return n, err
 			}
 		}
-		needsExtend = true
-		if err := c.WriteCluster(buffer); err != nil {
-			return n, err
-		}
 
 		if readErr == io.ErrUnexpectedEOF {
 			break
@@ -227,14 +775,19 @@ func (c *Chain) ReadFrom(r io.Reader) (n int64, err error) {
 }
 
 // WriteTo writes the entire chain to w.
+// Only one cluster is buffered at a time.
 func (c *Chain) WriteTo(w io.Writer) (n int64, err error) {
 	defer essentials.AddCtxTo("WriteTo", &err)
 	if _, err := c.Seek(0, io.SeekStart); err != nil {
 		return 0, err
 	}
+	if c.cluster == 0 {
+		return 0, nil
+	}
+	r := newFATReader(c.fs)
+	cluster := make([]byte, c.fs.ClusterSize())
 	for offset := int64(0); true; offset++ {
-		cluster, err := c.ReadCluster()
-		if err != nil {
+		if err := c.readClusterInto(cluster); err != nil {
 			return n, err
 		}
 		m, err := w.Write(cluster)
@@ -242,7 +795,7 @@ func (c *Chain) WriteTo(w io.Writer) (n int64, err error) {
 		if err != nil {
 			return n, err
 		}
-		if newOffset, err := c.Seek(1, io.SeekCurrent); err != nil {
+		if newOffset, err := c.advance(1, r); err != nil {
 			return n, err
 		} else if newOffset == offset {
 			break
@@ -251,20 +804,151 @@ func (c *Chain) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// CRC32 computes the IEEE CRC32 checksum of the first
+// size bytes of the chain.
+//
+// Only the clusters holding those bytes are visited, so
+// this is safe to use on cyclic chains.
+// If the chain is shorter than size bytes, it returns
+// io.ErrUnexpectedEOF.
+func (c *Chain) CRC32(size int64) (sum uint32, err error) {
+	defer essentials.AddCtxTo("CRC32", &err)
+	if size < 0 {
+		return 0, errors.New("negative size")
+	}
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, nil
+	} else if c.cluster == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, c.fs.ClusterSize())
+	r := newFATReader(c.fs)
+	for offset := int64(0); true; offset++ {
+		if err := c.readClusterInto(buf); err != nil {
+			return 0, err
+		}
+		if int64(len(buf)) > size {
+			buf = buf[:size]
+		}
+		sum = crc32.Update(sum, crc32.IEEETable, buf)
+		size -= int64(len(buf))
+		if size == 0 {
+			break
+		}
+		if newOffset, err := c.advance(1, r); err != nil {
+			return 0, err
+		} else if newOffset == offset {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return sum, nil
+}
+
+// NewReader creates a reader for the raw contents of the
+// chain, starting from its first cluster.
+//
+// Since a chain has no logical size, the reader produces
+// every byte of every cluster, including any slack at the
+// end of the final cluster.
+// Only one cluster is buffered at a time.
+//
+// The reader moves the chain as it reads, so the chain
+// should not be used elsewhere until reading is done.
+func (c *Chain) NewReader() io.Reader {
+	return &chainReader{chain: c}
+}
+
+type chainReader struct {
+	chain *Chain
+	fat   *fatReader
+	buf   []byte
+	done  bool
+}
+
+func (r *chainReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.fat == nil {
+			if _, err := r.chain.Seek(0, io.SeekStart); err != nil {
+				return 0, essentials.AddCtx("Read", err)
+			}
+			r.fat = newFATReader(r.chain.fs)
+			if r.chain.cluster == 0 {
+				r.done = true
+				continue
+			}
+		}
+		r.buf, r.done, err = r.chain.readNext(r.fat)
+		if err != nil {
+			return 0, essentials.AddCtx("Read", err)
+		}
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// ReadAll reads every cluster in the chain into memory.
+//
+// If the chain holds more than maxBytes bytes, it returns
+// ErrTooLarge without reading any clusters.
+// At most maxBytes worth of clusters are traversed, so
+// this is safe to use on cyclic chains.
+func (c *Chain) ReadAll(maxBytes int64) (data []byte, err error) {
+	defer essentials.AddCtxTo("ReadAll", &err)
+	maxClusters := maxBytes / int64(c.fs.ClusterSize())
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if c.cluster == 0 {
+		return nil, nil
+	}
+	lastIdx, err := c.Seek(maxClusters, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	} else if lastIdx == maxClusters {
+		return nil, ErrTooLarge
+	}
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data = make([]byte, 0, (lastIdx+1)*int64(c.fs.ClusterSize()))
+	r := newFATReader(c.fs)
+	for {
+		cluster, done, err := c.readNext(r)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, cluster...)
+		if done {
+			return data, nil
+		}
+	}
+}
+
 // ReadNext reads the current cluster and advances to the
 // next cluster.
 //
 // Sets done to true if this is the last cluster.
 func (c *Chain) ReadNext() (data []byte, done bool, err error) {
+	return c.readNext(newFATReader(c.fs))
+}
+
+func (c *Chain) readNext(r *fatReader) (data []byte, done bool, err error) {
 	data, err = c.ReadCluster()
 	if err != nil {
 		return
 	}
-	offset, err := c.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return
-	}
-	newOffset, err := c.Seek(1, io.SeekCurrent)
+	offset := int64(len(c.prev))
+	newOffset, err := c.advance(1, r)
 	if err != nil {
 		return
 	}
@@ -277,44 +961,101 @@ func (c *Chain) ReadNext() (data []byte, done bool, err error) {
 // Expands or truncates the chain as necessary.
 //
 // You must pass at least one cluster.
+//
+// The FAT is updated in a single pass: any new clusters
+// are allocated and linked, or any extra clusters are
+// freed, with each affected FAT sector written once.
+// Then the clusters are written in order.
+// Afterwards, the chain is positioned at its last cluster.
 func (c *Chain) SetClusters(clusters [][]byte) (err error) {
 	defer essentials.AddCtxTo("SetClusters", &err)
 	if len(clusters) == 0 {
 		panic("must write at least one cluster")
 	}
-	length, err := c.Seek(0, io.SeekEnd)
+	for _, data := range clusters {
+		if len(data) != c.fs.ClusterSize() {
+			return errors.New("incorrect cluster size")
+		}
+	}
+	list, err := c.AppendClusters(nil)
 	if err != nil {
 		return err
 	}
-	length++
-	for length < int64(len(clusters)) {
-		if err := c.Extend(); err != nil {
+	c.cache = nil
+
+	n := len(clusters)
+	entries := map[uint32]uint32{}
+	if len(list) < n {
+		added, err := c.fs.findFreeClusters(n - len(list))
+		if err != nil {
+			return err
+		}
+		start := len(list)
+		list = append(list, added...)
+		for i := start; i < n; i++ {
+			if i > 0 {
+				entries[list[i-1]] = list[i]
+			}
+		}
+		entries[list[n-1]] = EOF
+		if err := c.fs.writeFATEntries(entries); err != nil {
 			return err
 		}
-		length++
+		c.fs.allocCursor = added[len(added)-1] + 1
+	} else if len(list) > n {
+		entries[list[n-1]] = EOF
+		for _, cluster := range list[n:] {
+			entries[cluster] = 0
+		}
+		if err := c.fs.writeFATEntries(entries); err != nil {
+			return err
+		}
+		list = list[:n]
 	}
-	for length > int64(len(clusters)) {
-		if err := c.Truncate(); err != nil {
+
+	c.prev = list[:n-1]
+	for i, data := range clusters {
+		c.cluster = list[i]
+		if err := c.writeSectors(data, 0, int(c.fs.BootSector.SecPerClus())-1); err != nil {
 			return err
 		}
-		length--
 	}
-	if _, err := c.Seek(0, io.SeekStart); err != nil {
+	return nil
+}
+
+// writeSectors writes sectors first through last
+// (inclusive) of the current cluster, taking their
+// contents from a full cluster of data.
+//
+// Device errors are returned as an *FSError without an
+// operation.
+func (c *Chain) writeSectors(data []byte, first, last int) error {
+	offset, err := c.clusterSector()
+	if err != nil {
 		return err
 	}
-	for _, cluster := range clusters {
-		if err := c.WriteCluster(cluster); err != nil {
-			return err
-		}
-		if _, err := c.Seek(1, io.SeekCurrent); err != nil {
-			return err
+	var chunk Sector
+	for i := first; i <= last; i++ {
+		copy(chunk[:], data[i*SectorSize:])
+		if err := c.fs.writeSector(offset+uint32(i), &chunk); err != nil {
+			return &FSError{Cluster: c.cluster, Sector: offset + uint32(i), Err: err}
 		}
 	}
 	return nil
 }
 
-func (c *Chain) clusterSector() uint32 {
-	b := c.fs.BootSector
-	firstData := uint32(b.RsvdSecCnt()) + uint32(b.NumFATs())*b.FatSz32()
-	return firstData + (c.cluster-2)*uint32(b.SecPerClus())
+// clusterSector gets the first sector of the current
+// cluster, checking that the whole cluster is in the data
+// region and on the device.
+func (c *Chain) clusterSector() (uint32, error) {
+	if c.cluster < 2 || c.cluster >= c.fs.NumClusters() {
+		return 0, ErrClusterOutOfRange
+	}
+	firstData, _ := c.fs.DataRegion()
+	secPerClus := uint64(c.fs.BootSector.SecPerClus())
+	sector := uint64(firstData) + uint64(c.cluster-2)*secPerClus
+	if sector+secPerClus > uint64(c.fs.Device.NumSectors()) {
+		return 0, ErrClusterBeyondDevice
+	}
+	return uint32(sector), nil
 }
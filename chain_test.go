@@ -1,7 +1,14 @@
 package fatfs
 
 import (
+	"bytes"
+	"errors"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -132,9 +139,925 @@ func TestChainFree(t *testing.T) {
 	}
 }
 
+func TestChainInvalidCluster(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, fs.ClusterSize())
+	if err := NewChain(fs, fs.NumClusters()-1).WriteCluster(data); err != nil {
+		t.Errorf("last cluster: %v", err)
+	}
+	for _, cluster := range []uint32{0, 1, fs.NumClusters(), fs.NumClusters() + 5, EOF} {
+		chain := NewChain(fs, cluster)
+		if _, err := chain.ReadCluster(); !errors.Is(err, ErrInvalidCluster) {
+			t.Errorf("cluster %d: unexpected read error: %v", cluster, err)
+		}
+		if err := chain.WriteCluster(data); !errors.Is(err, ErrInvalidCluster) {
+			t.Errorf("cluster %d: unexpected write error: %v", cluster, err)
+		}
+		if _, err := chain.ReadCluster(); !errors.Is(err, ErrClusterOutOfRange) {
+			t.Errorf("cluster %d: expected ErrClusterOutOfRange but got %v", cluster, err)
+		}
+	}
+	if errors.Is(ErrInvalidCluster, ErrClusterOutOfRange) {
+		t.Error("ErrClusterOutOfRange should be distinct from ErrInvalidCluster")
+	}
+}
+
+func TestChainReadFromBuffered(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, fs.ClusterSize()*11/2)
+	rand.Read(data)
+	for _, bufClusters := range []int{1, 2, 3, 8} {
+		cluster, err := fs.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := NewChain(fs, cluster)
+		if n, err := chain.ReadFromBuffered(bytes.NewReader(data), bufClusters); err != nil {
+			t.Fatal(err)
+		} else if n != int64(len(data)) {
+			t.Errorf("buffer %d: expected %d bytes but got %d", bufClusters, len(data), n)
+		}
+		var out bytes.Buffer
+		if _, err := chain.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() != fs.ClusterSize()*6 {
+			t.Errorf("buffer %d: unexpected chain size %d", bufClusters, out.Len())
+		}
+		if !bytes.Equal(out.Bytes()[:len(data)], data) {
+			t.Errorf("buffer %d: data mismatch", bufClusters)
+		}
+		for _, b := range out.Bytes()[len(data):] {
+			if b != 0 {
+				t.Errorf("buffer %d: expected zero padding", bufClusters)
+				break
+			}
+		}
+	}
+}
+
+func TestChainNewReader(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, cluster)
+	data := make([]byte, fs.ClusterSize()*5/2)
+	rand.Read(data)
+	if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	if _, err := chain.WriteTo(&expected); err != nil {
+		t.Fatal(err)
+	}
+
+	r := chain.NewReader()
+	var actual []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := r.Read(buf)
+		actual = append(actual, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(actual, expected.Bytes()) {
+		t.Error("unexpected data")
+	}
+
+	empty, err := ioutil.ReadAll(NewChain(fs, 0).NewReader())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(empty) != 0 {
+		t.Errorf("expected no data from empty chain but got %d bytes", len(empty))
+	}
+}
+
+func TestChainAppendClusters(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	for i := 0; i < 4; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := chain.Seek(2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint32{1337, 2, 3, 4, 5, 6}
+	dst := make([]uint32, 1, 10)
+	dst[0] = 1337
+	actual, err := chain.AppendClusters(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+	if &actual[0] != &dst[0] {
+		t.Error("capacity was not reused")
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 2 {
+		t.Errorf("expected offset 2 but got %d", offset)
+	}
+
+	if err := fs.WriteFAT(6, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RootDirChain(fs).AppendClusters(nil); err == nil {
+		t.Error("expected error for cyclic chain")
+	}
+}
+
+func TestChainClusterAt(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	for i := 0; i < 3; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := chain.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, fs.ClusterSize())
+	rand.Read(data)
+	if err := chain.WriteClusterAt(3, data); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 1 {
+		t.Errorf("expected offset 1 but got %d", offset)
+	}
+	actual, err := chain.ReadClusterAt(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Error("unexpected cluster data")
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 1 {
+		t.Errorf("expected offset 1 but got %d", offset)
+	}
+
+	if err := chain.WriteClusterAt(4, data); err == nil {
+		t.Error("expected error past end of chain")
+	}
+	if _, err := chain.ReadClusterAt(-1); err == nil {
+		t.Error("expected error for negative offset")
+	}
+	if err := chain.WriteClusterAt(0, data[1:]); err == nil {
+		t.Error("expected error for short cluster")
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 1 {
+		t.Errorf("expected offset 1 but got %d", offset)
+	}
+}
+
+func TestChainReadTail(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	data := make([]byte, clusterSize*3)
+	rand.Read(data)
+	chain := NewChain(fs, 0)
+	if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, clusterSize - 1, clusterSize, clusterSize + 17,
+		clusterSize * 3} {
+		tail, err := chain.ReadTail(int64(size))
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+			continue
+		}
+		start := 0
+		if size > 0 {
+			start = (size - 1) / clusterSize * clusterSize
+		}
+		if !bytes.Equal(tail, data[start:size]) {
+			t.Errorf("size %d: expected %d bytes but got %d", size, size-start, len(tail))
+		}
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 1 {
+		t.Errorf("expected offset 1 but got %d", offset)
+	}
+	for _, size := range []int64{-1, int64(clusterSize*3 + 1)} {
+		if _, err := chain.ReadTail(size); err == nil {
+			t.Errorf("size %d: expected error", size)
+		}
+	}
+}
+
+func TestChainLastCluster(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	if last, err := chain.LastCluster(); err != nil {
+		t.Fatal(err)
+	} else if last != 2 {
+		t.Errorf("expected cluster 2 but got %d", last)
+	}
+	for i := 0; i < 3; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := chain.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := chain.LastCluster(); err != nil {
+		t.Fatal(err)
+	} else if last != 5 {
+		t.Errorf("expected cluster 5 but got %d", last)
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 1 {
+		t.Errorf("expected offset 1 but got %d", offset)
+	}
+	if last, err := NewChain(fs, 0).LastCluster(); err != nil || last != 0 {
+		t.Errorf("unexpected result for empty chain: %d, %v", last, err)
+	}
+}
+
+func TestChainPeekNext(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	if err := chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if next, isEOF, err := chain.PeekNext(); err != nil || isEOF || next != 3 {
+		t.Errorf("unexpected result: %d, %v, %v", next, isEOF, err)
+	}
+	if offset, _ := chain.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Errorf("chain moved to offset %d", offset)
+	}
+	if _, err := chain.Seek(1, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if next, isEOF, err := chain.PeekNext(); err != nil || !isEOF || next != 0 {
+		t.Errorf("unexpected result at end: %d, %v, %v", next, isEOF, err)
+	}
+	if _, isEOF, err := NewChain(fs, 0).PeekNext(); err != nil || !isEOF {
+		t.Errorf("unexpected result for empty chain: %v, %v", isEOF, err)
+	}
+}
+
+func TestChainCRC32(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, cluster)
+	data := make([]byte, fs.ClusterSize()*5/2)
+	rand.Read(data)
+	if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, fs.ClusterSize(), len(data)} {
+		if sum, err := chain.CRC32(int64(size)); err != nil {
+			t.Fatal(err)
+		} else if expected := crc32.ChecksumIEEE(data[:size]); sum != expected {
+			t.Errorf("size %d: expected %08x but got %08x", size, expected, sum)
+		}
+	}
+	if _, err := chain.CRC32(int64(fs.ClusterSize()*3 + 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected ErrUnexpectedEOF but got %v", err)
+	}
+}
+
+func TestChainClear(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keepCluster := range []bool{false, true} {
+		cluster, err := fs.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := NewChain(fs, cluster)
+		data := make([]byte, fs.ClusterSize()*3)
+		rand.Read(data)
+		if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		clusters, err := chain.AppendClusters(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chain.Clear(keepCluster); err != nil {
+			t.Fatal(err)
+		}
+		remaining, err := chain.AppendClusters(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keepCluster {
+			if len(remaining) != 1 || remaining[0] != clusters[0] {
+				t.Errorf("expected only cluster %d but got %v", clusters[0], remaining)
+			}
+			contents, err := chain.ReadCluster()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(contents, make([]byte, len(contents))) {
+				t.Error("kept cluster was not zeroed")
+			}
+			clusters = clusters[1:]
+		} else if len(remaining) != 0 || chain.FirstCluster() != 0 {
+			t.Errorf("expected empty chain but got %v", remaining)
+		}
+		for _, cluster := range clusters {
+			if contents, err := fs.ReadFAT(cluster); err != nil {
+				t.Fatal(err)
+			} else if contents != 0 {
+				t.Errorf("cluster %d was not freed", cluster)
+			}
+		}
+
+		// The chain can be reused.
+		if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if sum, err := chain.CRC32(int64(len(data))); err != nil {
+			t.Fatal(err)
+		} else if sum != crc32.ChecksumIEEE(data) {
+			t.Error("unexpected data after reuse")
+		}
+	}
+
+	empty := NewChain(fs, 0)
+	if err := empty.Clear(true); err != nil {
+		t.Fatal(err)
+	}
+	if empty.FirstCluster() == 0 {
+		t.Error("expected a cluster to be allocated")
+	}
+}
+
+func TestChainReadAll(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	data := make([]byte, clusterSize*3)
+	rand.Read(data)
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, cluster)
+	if _, err := chain.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxBytes := range []int64{int64(len(data)), int64(len(data)) + 1, 1 << 30} {
+		actual, err := chain.ReadAll(maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, data) {
+			t.Errorf("max %d: data mismatch", maxBytes)
+		}
+	}
+	for _, maxBytes := range []int64{0, int64(len(data)) - 1} {
+		if _, err := chain.ReadAll(maxBytes); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("max %d: expected ErrTooLarge but got %v", maxBytes, err)
+		}
+	}
+
+	// Make the chain loop back to its start.
+	if _, err := chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFAT(chain.cluster, cluster); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.ReadAll(int64(clusterSize) * 100); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge for cyclic chain but got %v", err)
+	}
+}
+
+func TestChainCache(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	for i := 0; i < 10; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := chain.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Cache(); err != nil {
+		t.Fatal(err)
+	}
+	verifyCluster(t, chain)
+	if offset, err := chain.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	} else if offset != 3 {
+		t.Errorf("expected offset 3 but got %d", offset)
+	}
+
+	var reads int
+	fs.OnSectorRead = func(sector uint32) {
+		reads++
+	}
+	for _, seek := range [][3]int64{{0, io.SeekStart, 0}, {100, io.SeekStart, 10},
+		{-4, io.SeekCurrent, 6}, {2, io.SeekCurrent, 8}, {-1, io.SeekEnd, 9}} {
+		if offset, err := chain.Seek(seek[0], int(seek[1])); err != nil {
+			t.Fatal(err)
+		} else if offset != seek[2] {
+			t.Errorf("seek %v: got offset %d", seek, offset)
+		}
+		verifyCluster(t, chain)
+	}
+	if reads != 0 {
+		t.Errorf("expected no reads but got %d", reads)
+	}
+
+	if err := chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	verifyCluster(t, chain)
+	if _, err := chain.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if offset != 11 {
+		t.Errorf("expected offset 11 after extending but got %d", offset)
+	}
+	verifyCluster(t, chain)
+}
+
+func TestChainFATReads(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+	for i := 0; i < 300; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var fatReads int
+	fs.OnSectorRead = func(sector uint32) {
+		if fs.sectorIntent(sector) == "FAT" {
+			fatReads++
+		}
+	}
+	// The chain spans three FAT sectors, so each walk
+	// should read each of them once.
+	check := func(name string, maxReads int, f func() error) {
+		fatReads = 0
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+		if fatReads > maxReads {
+			t.Errorf("%s: expected at most %d FAT reads but got %d", name, maxReads, fatReads)
+		}
+	}
+	check("Seek", 3, func() error {
+		if _, err := chain.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := chain.Seek(0, io.SeekEnd)
+		return err
+	})
+	check("WriteTo", 3, func() error {
+		_, err := chain.WriteTo(ioutil.Discard)
+		return err
+	})
+	check("ReadAll", 6, func() error {
+		_, err := chain.ReadAll(1 << 30)
+		return err
+	})
+
+	fs.OnSectorRead = nil
+	if err := chain.Free(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(3); i < 400; i++ {
+		if contents, err := fs.ReadFAT(i); err != nil {
+			t.Fatal(err)
+		} else if contents != 0 {
+			t.Fatalf("cluster %d was not freed", i)
+		}
+	}
+}
+
 func verifyCluster(t *testing.T, c *Chain) {
 	expected := uint32(len(c.prev) + 2)
 	if c.cluster != expected {
 		t.Errorf("expected cluster %d but got %d", expected, c.cluster)
 	}
 }
+
+func TestWriteClusterZero(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writes int
+	fs.OnSectorWrite = func(sector uint32) {
+		writes++
+	}
+	chain := NewChain(fs, 0)
+	if err := chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+
+	writes = 0
+	if err := chain.WriteClusterZero(); err != nil {
+		t.Fatal(err)
+	}
+	if writes != 0 {
+		t.Errorf("expected no writes but got %d", writes)
+	}
+
+	data := make([]byte, fs.ClusterSize())
+	data[len(data)-1] = 1
+	if err := chain.WriteCluster(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []BlockDevice{dev, struct{ BlockDevice }{dev}} {
+		fs.Device = device
+		writes = 0
+		if err := chain.WriteClusterZero(); err != nil {
+			t.Fatal(err)
+		}
+		if writes != int(fs.BootSector.SecPerClus()) {
+			t.Errorf("expected %d writes but got %d", fs.BootSector.SecPerClus(), writes)
+		}
+		if actual, err := chain.ReadCluster(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(actual, make([]byte, len(actual))) {
+			t.Error("cluster was not zeroed")
+		}
+	}
+}
+
+func TestChainAllocatedBytes(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, 0)
+	if n, err := chain.AllocatedBytes(); err != nil || n != 0 {
+		t.Errorf("expected (0, nil) but got (%d, %v)", n, err)
+	}
+	if _, err := chain.ReadFrom(bytes.NewReader(make([]byte, fs.ClusterSize()*2+1))); err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(fs.ClusterSize() * 3)
+	if n, err := chain.AllocatedBytes(); err != nil || n != expected {
+		t.Errorf("expected (%d, nil) but got (%d, %v)", expected, n, err)
+	}
+	if err := chain.Cache(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := chain.AllocatedBytes(); err != nil || n != expected {
+		t.Errorf("cached: expected (%d, nil) but got (%d, %v)", expected, n, err)
+	}
+}
+
+func TestChainsOverlap(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]uint32{
+		{100, 101}, {101, 102}, {102, EOF},
+		{200, 201}, {201, EOF},
+		{300, 102},
+		{400, 401}, {401, 400},
+		{500, 401},
+	}
+	for _, link := range links {
+		if err := fs.WriteFAT(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		a, b     uint32
+		expected bool
+	}{
+		{100, 200, false},
+		{100, 300, true},
+		{300, 100, true},
+		{100, 100, true},
+		{400, 500, true},
+		{400, 100, false},
+		{0, 100, false},
+	}
+	for _, tc := range testCases {
+		overlap, err := ChainsOverlap(NewChain(fs, tc.a), NewChain(fs, tc.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overlap != tc.expected {
+			t.Errorf("%d and %d: expected %v but got %v", tc.a, tc.b, tc.expected, overlap)
+		}
+	}
+}
+
+func TestClusterForOffset(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]uint32{
+		{100, 205}, {205, 150}, {150, EOF},
+		{400, 401}, {401, 400},
+		{500, 0},
+	}
+	for _, link := range links {
+		if err := fs.WriteFAT(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int64(fs.ClusterSize())
+	for off, expected := range map[int64][2]int{
+		0:            {100, 0},
+		size - 1:     {100, int(size - 1)},
+		size:         {205, 0},
+		size*2 + 123: {150, 123},
+		size*3 - 1:   {150, int(size - 1)},
+	} {
+		cluster, within, err := fs.ClusterForOffset(100, off)
+		if err != nil {
+			t.Errorf("offset %d: %v", off, err)
+		} else if cluster != uint32(expected[0]) || within != expected[1] {
+			t.Errorf("offset %d: expected %v but got %d, %d", off, expected, cluster, within)
+		}
+	}
+	for _, tc := range []struct {
+		first uint32
+		off   int64
+	}{
+		{100, size * 3},
+		{100, -1},
+		{0, 0},
+		{400, size * 2},
+		{500, size},
+		{1, 0},
+	} {
+		if _, _, err := fs.ClusterForOffset(tc.first, tc.off); err == nil {
+			t.Errorf("%d at offset %d: expected error", tc.first, tc.off)
+		}
+	}
+	if cluster, _, err := fs.ClusterForOffset(400, size); err != nil {
+		t.Error(err)
+	} else if cluster != 401 {
+		t.Errorf("expected cluster 401 but got %d", cluster)
+	}
+}
+
+func TestClusterBeyondDevice(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := fs.MaxClusterIndex()
+	chain := NewChain(fs, last)
+	data := make([]byte, fs.ClusterSize())
+	if err := chain.WriteCluster(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a device that is smaller than the volume.
+	_, dataSectors := fs.DataRegion()
+	slack := int(dataSectors % uint32(fs.BootSector.SecPerClus()))
+	fs.Device = dev[:len(dev)-(slack+1)*SectorSize]
+	if err := chain.WriteCluster(data); err == nil ||
+		!strings.HasSuffix(err.Error(), ErrClusterBeyondDevice.Error()) {
+		t.Errorf("expected ErrClusterBeyondDevice but got %v", err)
+	}
+	if _, err := chain.ReadCluster(); err == nil {
+		t.Error("expected error reading beyond the device")
+	}
+	if err := NewChain(fs, last-1).WriteCluster(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChainSetClusters(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clusters [][]byte
+	for i := 0; i < 300; i++ {
+		data := make([]byte, fs.ClusterSize())
+		rand.Read(data)
+		clusters = append(clusters, data)
+	}
+	freeBefore, err := fs.CountFreeClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := NewChain(fs, 0)
+	for _, count := range []int{1, 300, 7, 200} {
+		if err := chain.SetClusters(clusters[:count]); err != nil {
+			t.Fatal(err)
+		}
+		data, err := NewChain(fs, chain.FirstCluster()).ReadAll(1 << 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, bytes.Join(clusters[:count], nil)) {
+			t.Errorf("%d clusters: unexpected contents", count)
+		}
+		free, err := fs.CountFreeClusters()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if free != freeBefore-uint32(count) {
+			t.Errorf("%d clusters: expected %d free but got %d", count, freeBefore-uint32(count), free)
+		}
+		if last, err := chain.LastCluster(); err != nil {
+			t.Fatal(err)
+		} else if last != chain.cluster {
+			t.Errorf("%d clusters: chain is not at its last cluster", count)
+		}
+	}
+}
+
+func BenchmarkSetClusters(b *testing.B) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	clusters := make([][]byte, 1000)
+	for i := range clusters {
+		clusters[i] = make([]byte, fs.ClusterSize())
+	}
+	var accesses int
+	fs.OnSectorRead = func(sector uint32) {
+		accesses++
+	}
+	fs.OnSectorWrite = fs.OnSectorRead
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain := NewChain(fs, 0)
+		if err := chain.SetClusters(clusters); err != nil {
+			b.Fatal(err)
+		}
+		if err := chain.SetClusters(clusters[:500]); err != nil {
+			b.Fatal(err)
+		}
+		if err := chain.Free(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(accesses)/float64(b.N), "sectors/op")
+}
+
+func TestWriteClusterFrom(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, fs.ClusterSize()*5/2)
+	rand.Read(data)
+
+	chain := NewChain(fs, 0)
+	hash := crc32.NewIEEE()
+	r := io.TeeReader(bytes.NewReader(data), hash)
+	var numClusters int
+	for {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+		numClusters++
+		done, err := chain.WriteClusterFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			break
+		}
+	}
+	if numClusters != 3 {
+		t.Errorf("expected 3 clusters but got %d", numClusters)
+	}
+	if hash.Sum32() != crc32.ChecksumIEEE(data) {
+		t.Error("unexpected hash")
+	}
+	actual, err := NewChain(fs, chain.FirstCluster()).ReadAll(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte{}, data...), make([]byte, fs.ClusterSize()/2)...)
+	if !bytes.Equal(actual, expected) {
+		t.Error("unexpected contents")
+	}
+
+	before := append([]byte{}, actual[:fs.ClusterSize()]...)
+	first := NewChain(fs, chain.FirstCluster())
+	if done, err := first.WriteClusterFrom(bytes.NewReader(nil)); err != nil || !done {
+		t.Errorf("expected (true, nil) but got (%v, %v)", done, err)
+	}
+	if cluster, err := first.ReadCluster(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(cluster, before) {
+		t.Error("empty reader should not write")
+	}
+}
+
+func TestNewChainAlloc(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := fs.NewChainAlloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := chain.FirstCluster()
+	if cluster < 2 || cluster >= fs.NumClusters() {
+		t.Fatalf("invalid cluster: %d", cluster)
+	}
+	if next, err := fs.ReadFAT(cluster); err != nil || next < EOF {
+		t.Errorf("expected EOF but got (%d, %v)", next, err)
+	}
+	if other, err := fs.NewChainAlloc(); err != nil {
+		t.Fatal(err)
+	} else if other.FirstCluster() == cluster {
+		t.Error("cluster allocated twice")
+	}
+	if err := chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	if clusters, err := chain.AppendClusters(nil); err != nil || len(clusters) != 2 ||
+		clusters[0] != cluster {
+		t.Errorf("unexpected clusters: %v, %v", clusters, err)
+	}
+}
@@ -0,0 +1,127 @@
+package fatfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/unixpickle/essentials"
+)
+
+// CopyAcross copies a file or directory from one
+// file-system to another.
+//
+// Directories are copied recursively, and any missing
+// parents of dstPath are created.
+// If both the source and destination are directories,
+// the source's contents are merged into the destination.
+// Otherwise, it is an error for dstPath to exist.
+//
+// File data is streamed a cluster at a time, so files
+// are never buffered in memory.
+// Names, attributes, and timestamps are preserved.
+//
+// If dst runs out of space, ErrNoSpace is returned and
+// the partially copied file is removed.
+func CopyAcross(dst *FS, dstPath string, src *FS, srcPath string) (err error) {
+	defer essentials.AddCtxTo("CopyAcross", &err)
+
+	dstNames, err := CleanPath(dstPath)
+	if err != nil {
+		return err
+	}
+	if srcNames, err := CleanPath(srcPath); err != nil {
+		return err
+	} else if len(srcNames) == 0 {
+		dstDir, err := dst.MkdirAll(dstPath, dst.now())
+		if err != nil {
+			return err
+		}
+		return copyDirContents(dstDir, NewDir(src.RootDir()))
+	}
+
+	srcEntry, err := src.Lookup(srcPath)
+	if err != nil {
+		return err
+	}
+	if len(dstNames) == 0 {
+		if !srcEntry.Raw().IsDir() {
+			return errors.New("cannot replace root directory with a file")
+		}
+		srcDir := NewDir(NewChain(src, srcEntry.Raw().FirstCluster()))
+		return copyDirContents(NewDir(dst.RootDir()), srcDir)
+	}
+
+	parentPath := strings.Join(dstNames[:len(dstNames)-1], "/")
+	dstParent, err := dst.MkdirAll(parentPath, dst.now())
+	if err != nil {
+		return err
+	}
+	return copyEntry(dstParent, dstNames[len(dstNames)-1], src, srcEntry)
+}
+
+func copyEntry(dstParent *Dir, name string, src *FS, srcEntry DirEntry) error {
+	dst := dstParent.Chain.FS()
+	srcChain := NewChain(src, srcEntry.Raw().FirstCluster())
+
+	existing, err := dstParent.Lookup(name)
+	if err == nil {
+		if existing.Raw().IsDir() && srcEntry.Raw().IsDir() {
+			dstDir := NewDir(NewChain(dst, existing.Raw().FirstCluster()))
+			return copyDirContents(dstDir, NewDir(srcChain))
+		}
+		return os.ErrExist
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	listing, err := dstParent.ReadDir()
+	if err != nil {
+		return err
+	}
+	entry, err := shortNamesOf(listing).unique(name,
+		NewDirEntry(name, 0, 0, dst.now(), srcEntry.Raw().IsDir()))
+	if err != nil {
+		return err
+	}
+	entry.Raw().SetAttr(srcEntry.Raw().Attr())
+	entry.Raw().copyTimes(srcEntry.Raw())
+
+	if srcEntry.Raw().IsDir() {
+		dstDir, err := mkdir(dstParent, entry)
+		if err != nil {
+			return err
+		}
+		return copyDirContents(dstDir, NewDir(srcChain))
+	}
+
+	size := int64(srcEntry.Raw().FileSize())
+	chain := NewChain(dst, 0)
+	if _, err := chain.ReadFrom(NewFile(srcChain, size).Section(0, size)); err != nil {
+		chain.Free()
+		return err
+	}
+	entry.Raw().SetFirstCluster(chain.FirstCluster())
+	entry.Raw().SetFileSize(uint32(size))
+	if err := dstParent.AddEntry(entry); err != nil {
+		chain.Free()
+		return err
+	}
+	return nil
+}
+
+func copyDirContents(dst, src *Dir) error {
+	listing, err := src.ReadDir()
+	if err != nil {
+		return err
+	}
+	for _, entry := range listing {
+		if entry.Raw().IsDotPointer() || entry.Raw().Attr()&VolumeID != 0 {
+			continue
+		}
+		if err := copyEntry(dst, entry.Name(), src.Chain.FS(), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package fatfs
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyAcross(t *testing.T) {
+	src, err := FormatFS(make(RAMDisk, 4096*80000), "SRC", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := FormatFS(make(RAMDisk, 4096*80000), "DST", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2015, 3, 14, 15, 9, 26, 0, time.UTC)
+	files := map[string][]byte{
+		"docs/readme.txt":          []byte("read me"),
+		"docs/empty":               nil,
+		"docs/images/big file.bin": make([]byte, 50000),
+		"top.txt":                  []byte("top level"),
+	}
+	rand.Read(files["docs/images/big file.bin"])
+	for path, contents := range files {
+		dirPath, name := splitPathParent(path)
+		dir, err := src.MkdirAll(dirPath, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateFile(dir, name, bytes.NewReader(contents), date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CopyAcross(dst, "backup/docs", src, "docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyAcross(dst, "/", src, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyAcross(dst, "top.txt", src, "top.txt"); err == nil {
+		t.Error("expected error when overwriting a file")
+	}
+
+	for path, contents := range files {
+		for _, dstPath := range []string{path, "backup/" + path} {
+			if dstPath == "backup/top.txt" {
+				continue
+			}
+			entry, err := dst.Lookup(dstPath)
+			if err != nil {
+				t.Errorf("%s: %v", dstPath, err)
+				continue
+			}
+			srcEntry, err := src.Lookup(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Name() != srcEntry.Name() {
+				t.Errorf("%s: expected name %s but got %s", dstPath, srcEntry.Name(), entry.Name())
+			}
+			if entry.Raw().WrtDate() != srcEntry.Raw().WrtDate() ||
+				entry.Raw().CrtTime() != srcEntry.Raw().CrtTime() {
+				t.Errorf("%s: timestamps not preserved", dstPath)
+			}
+			file, err := dst.OpenFile(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := make([]byte, file.Size)
+			if _, err := file.ReadAt(actual, 0); err != nil && len(actual) > 0 {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, contents) {
+				t.Errorf("%s: contents do not match", dstPath)
+			}
+		}
+	}
+
+	dir, err := dst.Lookup("backup/docs/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dir.Raw().IsDir() || dir.Raw().WrtDate() != fatDate(date) {
+		t.Error("directory attributes were not preserved")
+	}
+}
+
+func splitPathParent(path string) (string, string) {
+	names, _ := CleanPath(path)
+	return strings.Join(names[:len(names)-1], "/"), names[len(names)-1]
+}
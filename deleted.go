@@ -0,0 +1,97 @@
+package fatfs
+
+import (
+	"errors"
+	"io"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A DeletedEntry is a short directory entry which has
+// been marked as deleted.
+type DeletedEntry struct {
+	// Name is the unformatted short name of the entry.
+	// Deleting an entry overwrites the first character
+	// of its name, so that character is replaced by '?'.
+	Name string
+
+	// Raw is a copy of the deleted entry.
+	// The first byte of its name is 0xE5.
+	Raw *RawDirEntry
+}
+
+// ScanDeleted finds all the deleted short entries in a
+// directory.
+//
+// Deleted long name entries are ignored, since the short
+// entries contain all the information needed to recover
+// a file.
+func (f *FS) ScanDeleted(dir *Chain) (entries []DeletedEntry, err error) {
+	defer essentials.AddCtxTo("ScanDeleted", &err)
+	if _, err := dir.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := newFATReader(dir.FS())
+	for {
+		cluster, done, err := dir.readNext(r)
+		if err != nil {
+			return entries, err
+		}
+		for i := 0; i < len(cluster); i += 32 {
+			var entry RawDirEntry
+			copy(entry[:], cluster[i:])
+			if entry.Name()[0] != 0xe5 || entry.IsLongName() {
+				continue
+			}
+			name := append([]byte{'?'}, entry.Name()[1:]...)
+			entries = append(entries, DeletedEntry{
+				Name: UnformatName(string(name)),
+				Raw:  &entry,
+			})
+		}
+		if done {
+			break
+		}
+	}
+	return
+}
+
+// RecoverDeleted attempts to write the contents of a
+// deleted file to w.
+//
+// Since the FAT entries of a deleted file are zeroed,
+// the file is assumed to occupy consecutive clusters
+// starting at its first cluster.
+// Recovery fails if any of these clusters has been
+// allocated since the file was deleted.
+//
+// Returns the number of bytes written to w.
+func (f *FS) RecoverDeleted(entry DeletedEntry, w io.Writer) (n int64, err error) {
+	defer essentials.AddCtxTo("RecoverDeleted", &err)
+	size := int64(entry.Raw.FileSize())
+	cluster := entry.Raw.FirstCluster()
+	for n < size {
+		if cluster < 2 || cluster >= f.NumClusters() {
+			return n, errors.New("cluster out of bounds")
+		}
+		if contents, err := f.ReadFAT(cluster); err != nil {
+			return n, err
+		} else if contents != 0 {
+			return n, errors.New("cluster has been reused")
+		}
+		data, err := NewChain(f, cluster).ReadCluster()
+		if err != nil {
+			return n, err
+		}
+		if remaining := size - n; remaining < int64(len(data)) {
+			data = data[:remaining]
+		}
+		m, err := w.Write(data)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		cluster++
+	}
+	return n, nil
+}
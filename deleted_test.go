@@ -0,0 +1,74 @@
+package fatfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRecoverDeleted(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(RootDirChain(fs))
+
+	contents := make([]byte, 10000)
+	rand.Read(contents)
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, cluster)
+	if _, err := chain.ReadFrom(bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	entry := NewDirEntry("FOO.TXT", cluster, uint32(len(contents)), time.Now(), false)
+	if err := dir.AddEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the file the way other implementations do,
+	// leaving a marked entry behind.
+	if err := chain.Free(); err != nil {
+		t.Fatal(err)
+	}
+	dirData, err := dir.Chain.ReadCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirData[0] = 0xe5
+	if err := dir.Chain.WriteCluster(dirData); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := fs.ScanDeleted(dir.Chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Fatalf("expected 1 deleted entry but got %d", len(deleted))
+	}
+	if deleted[0].Name != "?OO.TXT" {
+		t.Errorf("unexpected name: %s", deleted[0].Name)
+	}
+
+	var recovered bytes.Buffer
+	if n, err := fs.RecoverDeleted(deleted[0], &recovered); err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(contents)) {
+		t.Errorf("expected %d bytes but got %d", len(contents), n)
+	}
+	if !bytes.Equal(recovered.Bytes(), contents) {
+		t.Error("recovered data does not match")
+	}
+
+	if _, err := fs.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.RecoverDeleted(deleted[0], &recovered); err == nil {
+		t.Error("expected error for reused cluster")
+	}
+}
@@ -20,10 +20,46 @@ type BlockDevice interface {
 	WriteSector(idx uint32, value *Sector) error
 }
 
+// A Syncer is a BlockDevice that can flush buffered
+// writes to persistent storage.
+//
+// FS.Sync uses this interface when it is available.
+type Syncer interface {
+	Sync() error
+}
+
+// A ZeroReporter is a BlockDevice that can tell when a
+// range of sectors contains only zeros, such as a device
+// which tracks the regions it has erased.
+//
+// Chain.WriteClusterZero uses this interface to skip
+// redundant writes.
+// A device should only report true if it is certain; if
+// in doubt, it should report false.
+type ZeroReporter interface {
+	SectorsZero(start, count uint32) (bool, error)
+}
+
 // A RAMDisk is a BlockDevice that is backed by a simple
 // memory buffer.
 type RAMDisk []byte
 
+// NewBytesDevice creates a RAMDisk that uses data as its
+// storage, so that writes to the device modify data.
+//
+// The length of data must be a multiple of SectorSize.
+func NewBytesDevice(data []byte) (RAMDisk, error) {
+	if len(data)%SectorSize != 0 {
+		return nil, errors.New("NewBytesDevice: length is not a multiple of the sector size")
+	}
+	return RAMDisk(data), nil
+}
+
+// Bytes returns the underlying memory buffer.
+func (r RAMDisk) Bytes() []byte {
+	return r
+}
+
 func (r RAMDisk) NumSectors() uint32 {
 	return uint32(len(r) / 512)
 }
@@ -39,6 +75,45 @@ func (r RAMDisk) WriteSector(idx uint32, value *Sector) error {
 	return nil
 }
 
+func (r RAMDisk) SectorsZero(start, count uint32) (bool, error) {
+	if uint64(start)+uint64(count) > uint64(r.NumSectors()) {
+		return false, essentials.AddCtx("SectorsZero", errors.New("sector out of bounds"))
+	}
+	for _, b := range r[int(start)*SectorSize : int(start+count)*SectorSize] {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// An OffsetDevice is a BlockDevice which exposes a range
+// of sectors of another device.
+// Sector 0 of the OffsetDevice is sector Start of Device.
+type OffsetDevice struct {
+	Device BlockDevice
+	Start  uint32
+	Count  uint32
+}
+
+func (o *OffsetDevice) NumSectors() uint32 {
+	return o.Count
+}
+
+func (o *OffsetDevice) ReadSector(idx uint32) (*Sector, error) {
+	if idx >= o.Count {
+		return nil, errors.New("ReadSector: sector out of bounds")
+	}
+	return o.Device.ReadSector(o.Start + idx)
+}
+
+func (o *OffsetDevice) WriteSector(idx uint32, value *Sector) error {
+	if idx >= o.Count {
+		return errors.New("WriteSector: sector out of bounds")
+	}
+	return o.Device.WriteSector(o.Start+idx, value)
+}
+
 // FileDevice is a BlockDevice that is backed by a file,
 // possibly a block device.
 type FileDevice struct {
@@ -88,3 +163,84 @@ func (f *FileDevice) WriteSector(idx uint32, data *Sector) (err error) {
 	_, err = f.file.WriteAt(data[:], int64(idx)*SectorSize)
 	return err
 }
+
+// Sync flushes the file's contents to stable storage.
+func (f *FileDevice) Sync() error {
+	return essentials.AddCtx("Sync", f.file.Sync())
+}
+
+// SparseFileDevice is a BlockDevice backed by a sparse
+// file.
+//
+// Sectors of zeros are not written unless the sector has
+// previously been written with other data, so that unused
+// regions of the device remain holes in the file.
+type SparseFileDevice struct {
+	file    *os.File
+	size    uint32
+	written []uint64
+}
+
+// NewSparseFileDevice creates a SparseFileDevice with the
+// given number of sectors.
+//
+// The file must be empty, since the device must know that
+// unwritten sectors are zero.
+func NewSparseFileDevice(f *os.File, numSectors uint32) (*SparseFileDevice, error) {
+	if info, err := f.Stat(); err != nil {
+		return nil, essentials.AddCtx("NewSparseFileDevice", err)
+	} else if info.Size() != 0 {
+		return nil, essentials.AddCtx("NewSparseFileDevice", errors.New("file is not empty"))
+	}
+	if err := f.Truncate(int64(numSectors) * SectorSize); err != nil {
+		return nil, essentials.AddCtx("NewSparseFileDevice", err)
+	}
+	return &SparseFileDevice{
+		file:    f,
+		size:    numSectors,
+		written: make([]uint64, (numSectors+63)/64),
+	}, nil
+}
+
+func (s *SparseFileDevice) NumSectors() uint32 {
+	return s.size
+}
+
+func (s *SparseFileDevice) ReadSector(idx uint32) (sec *Sector, err error) {
+	defer essentials.AddCtxTo("ReadSector", &err)
+	if idx >= s.size {
+		return nil, errors.New("sector out of bounds")
+	}
+	var res Sector
+	if !s.isWritten(idx) {
+		return &res, nil
+	}
+	if _, err := s.file.ReadAt(res[:], int64(idx)*SectorSize); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *SparseFileDevice) WriteSector(idx uint32, data *Sector) (err error) {
+	defer essentials.AddCtxTo("WriteSector", &err)
+	if idx >= s.size {
+		return errors.New("sector out of bounds")
+	}
+	if !s.isWritten(idx) {
+		if *data == (Sector{}) {
+			return nil
+		}
+		s.written[idx/64] |= 1 << (idx % 64)
+	}
+	_, err = s.file.WriteAt(data[:], int64(idx)*SectorSize)
+	return err
+}
+
+// Sync flushes the file's contents to stable storage.
+func (s *SparseFileDevice) Sync() error {
+	return essentials.AddCtx("Sync", s.file.Sync())
+}
+
+func (s *SparseFileDevice) isWritten(idx uint32) bool {
+	return s.written[idx/64]&(1<<(idx%64)) != 0
+}
@@ -0,0 +1,125 @@
+package fatfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSparseFileDevice(t *testing.T) {
+	f, err := ioutil.TempFile("", "fatfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	dev, err := NewSparseFileDevice(f, 80000*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Mkdir(NewDir(RootDirChain(fs)), "DIR", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSparseFileDevice(f, 80000*8); err == nil {
+		t.Error("expected error for non-empty file")
+	}
+
+	var zero Sector
+	if err := dev.WriteSector(100000, &zero); err != nil {
+		t.Fatal(err)
+	}
+	if dev.isWritten(100000) {
+		t.Error("zero sector should not be written")
+	}
+	data := Sector{1, 2, 3}
+	if err := dev.WriteSector(100000, &data); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WriteSector(100000, &zero); err != nil {
+		t.Fatal(err)
+	}
+	if sec, err := dev.ReadSector(100000); err != nil {
+		t.Fatal(err)
+	} else if *sec != zero {
+		t.Error("overwritten sector should be zero")
+	}
+
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := NewDir(RootDirChain(fs)).ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Name() != "DIR" {
+		t.Errorf("unexpected listing: %v", listing)
+	}
+
+	contents, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < dev.NumSectors(); i++ {
+		sec, err := dev.ReadSector(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sec[:], contents[i*SectorSize:(i+1)*SectorSize]) {
+			t.Fatalf("sector %d does not match file", i)
+		}
+	}
+}
+
+func TestBytesDevice(t *testing.T) {
+	if _, err := NewBytesDevice(make([]byte, SectorSize+1)); err == nil {
+		t.Error("expected error for partial sector")
+	}
+	data := make([]byte, SectorSize*3)
+	dev, err := NewBytesDevice(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.NumSectors() != 3 {
+		t.Errorf("expected 3 sectors but got %d", dev.NumSectors())
+	}
+	var sector Sector
+	sector[0] = 0x37
+	if err := dev.WriteSector(2, &sector); err != nil {
+		t.Fatal(err)
+	}
+	if data[SectorSize*2] != 0x37 {
+		t.Error("write did not modify the original slice")
+	}
+	if &dev.Bytes()[0] != &data[0] {
+		t.Error("Bytes did not return the original slice")
+	}
+}
+
+func TestRAMDiskSectorsZero(t *testing.T) {
+	dev := make(RAMDisk, SectorSize*4)
+	dev[SectorSize*2] = 1
+	for _, c := range []struct {
+		start, count uint32
+		zero         bool
+	}{{0, 2, true}, {1, 2, false}, {3, 1, true}, {4, 0, true}} {
+		if zero, err := dev.SectorsZero(c.start, c.count); err != nil {
+			t.Errorf("%d+%d: %v", c.start, c.count, err)
+		} else if zero != c.zero {
+			t.Errorf("%d+%d: expected %v but got %v", c.start, c.count, c.zero, zero)
+		}
+	}
+	for _, r := range [][2]uint32{{3, 2}, {5, 0}, {1, 0xffffffff}} {
+		if _, err := dev.SectorsZero(r[0], r[1]); err == nil {
+			t.Errorf("%d+%d: expected error", r[0], r[1])
+		}
+	}
+}
@@ -21,21 +21,56 @@ func NewDir(c *Chain) *Dir {
 
 // ReadDirRaw reads the raw directory listings.
 func (d *Dir) ReadDirRaw() (entries []*RawDirEntry, err error) {
-	defer essentials.AddCtxTo("ReadDirRaw", &err)
+	entries, _, err = d.readDirRaw()
+	return entries, essentials.AddCtx("ReadDirRaw", err)
+}
+
+// ReadDir reads the directory's entries.
+func (d *Dir) ReadDir() (entries []DirEntry, err error) {
+	entries, _, err = d.readDir()
+	return entries, essentials.AddCtx("ReadDir", err)
+}
+
+// A rawLocation is the position of a raw entry in a
+// directory's chain.
+type rawLocation struct {
+	// cluster is the cluster offset in the chain.
+	cluster int64
+
+	// offset is the byte offset within the cluster.
+	offset int
+}
+
+// readDirRaw reads the entries which are not free.
+//
+// Deleted entries are skipped by checking their first
+// byte, and the scan stops at the first entry starting
+// with 0x00, which marks the end of the directory, unless
+// it is padding as described in isDirEnd.
+// Clusters after the end are never read.
+func (d *Dir) readDirRaw() (entries []*RawDirEntry, locs []rawLocation, err error) {
 	if _, err := d.Chain.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	for {
-		cluster, done, err := d.Chain.ReadNext()
+	r := newFATReader(d.Chain.FS())
+	for clusterIdx := int64(0); true; clusterIdx++ {
+		cluster, done, err := d.Chain.readNext(r)
 		if err != nil {
-			return entries, err
+			return entries, locs, err
 		}
 		for i := 0; i < len(cluster); i += 32 {
-			var entry RawDirEntry
-			copy(entry[:], cluster[i:])
-			if !entry.IsFree() {
-				entries = append(entries, &entry)
+			if cluster[i] == 0xe5 {
+				continue
+			} else if cluster[i] == 0 {
+				if isDirEnd(cluster, i, done) {
+					return entries, locs, nil
+				}
+				break
 			}
+			entry := new(RawDirEntry)
+			copy(entry[:], cluster[i:])
+			entries = append(entries, entry)
+			locs = append(locs, rawLocation{cluster: clusterIdx, offset: i})
 		}
 		if done {
 			break
@@ -44,30 +79,52 @@ func (d *Dir) ReadDirRaw() (entries []*RawDirEntry, err error) {
 	return
 }
 
-// ReadDir reads the directory's entries.
-func (d *Dir) ReadDir() (entries []DirEntry, err error) {
-	defer essentials.AddCtxTo("ReadDir", &err)
-
-	rawEntries, err := d.ReadDirRaw()
+// readDir reads the directory's entries, along with the
+// location of each entry's short entry.
+//
+// Long name entries which do not belong to the following
+// short entry are ignored, as are long name entries at the
+// end of the directory with no short entry.
+// These are left behind if a write is interrupted, or if a
+// short entry is deleted by software that does not know
+// about long names.
+func (d *Dir) readDir() (entries []DirEntry, locs []rawLocation, err error) {
+	rawEntries, rawLocs, err := d.readDirRaw()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var longEntry DirEntry
-	for _, entry := range rawEntries {
-		longEntry = append(longEntry, entry)
-		if !entry.IsLongName() {
-			entries = append(entries, longEntry)
-			longEntry = DirEntry{}
+	for i, entry := range rawEntries {
+		if entry.IsLongName() {
+			if entry[0]&0x40 != 0 {
+				// The first part of a new long name.
+				longEntry = nil
+			}
+			longEntry = append(longEntry, entry)
+			continue
 		}
+		checksum := shortNameChecksum(entry.Name())
+		for _, part := range longEntry {
+			if part[13] != checksum {
+				longEntry = nil
+				break
+			}
+		}
+		entries = append(entries, append(longEntry, entry))
+		locs = append(locs, rawLocs[i])
+		longEntry = nil
 	}
-	if len(longEntry) > 0 {
-		return entries, errors.New("missing final short entry")
-	}
-	return entries, nil
+	return entries, locs, nil
 }
 
 // WriteDir updates the directory's entries.
+//
+// Since an entry cannot span clusters, a cluster may end
+// with unused space.
+// This space is filled with deleted entries, so that only
+// the end of the final cluster is marked as the end of the
+// directory.
 func (d *Dir) WriteDir(entries []DirEntry) (err error) {
 	defer essentials.AddCtxTo("WriteDir", &err)
 
@@ -77,10 +134,16 @@ func (d *Dir) WriteDir(entries []DirEntry) (err error) {
 	var currentCluster []byte
 
 	finishCurrent := func() {
-		currentCluster = append(currentCluster, make([]byte, clusterSize-len(currentCluster))...)
+		start := len(currentCluster)
+		currentCluster = append(currentCluster, make([]byte, clusterSize-start)...)
 		clusters = append(clusters, currentCluster)
 		currentCluster = nil
 	}
+	finishFull := func() {
+		start := len(currentCluster)
+		finishCurrent()
+		markDeleted(clusters[len(clusters)-1][start:])
+	}
 
 	for _, entry := range entries {
 		var encoded []byte
@@ -91,7 +154,7 @@ func (d *Dir) WriteDir(entries []DirEntry) (err error) {
 			return errors.New("entry is too large to fit into a cluster")
 		}
 		if len(encoded)+len(currentCluster) > clusterSize {
-			finishCurrent()
+			finishFull()
 		}
 		currentCluster = append(currentCluster, encoded...)
 	}
@@ -101,15 +164,85 @@ func (d *Dir) WriteDir(entries []DirEntry) (err error) {
 }
 
 // AddEntry adds a directory entry.
+//
+// The entry is placed after the last entry in the final
+// cluster of the directory, and only the sectors it
+// occupies are written.
+// If it does not fit, the directory is extended.
+//
+// Since the short entry comes after the long name entries,
+// the sectors are written in order so that the short
+// entry's sector is written last.
+// If a write is interrupted, the directory is left with at
+// most a run of long name entries without a short entry,
+// which readers ignore.
+// When the directory is extended, the new cluster is
+// written before it is linked into the directory.
 func (d *Dir) AddEntry(newEntry DirEntry) (err error) {
 	defer essentials.AddCtxTo("AddEntry", &err)
 
-	entries, err := d.ReadDir()
+	clusterSize := d.Chain.FS().ClusterSize()
+	var encoded []byte
+	for _, rawEntry := range newEntry {
+		encoded = append(encoded, rawEntry[:]...)
+	}
+	if len(encoded) > clusterSize {
+		return errors.New("entry is too large to fit into a cluster")
+	}
+
+	if _, err := d.Chain.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	cluster, err := d.Chain.ReadCluster()
 	if err != nil {
 		return err
 	}
-	entries = append(entries, newEntry)
-	return d.WriteDir(entries)
+	offset := len(cluster)
+	for offset > 0 && cluster[offset-32] == 0 {
+		offset -= 32
+	}
+	if offset+len(encoded) > clusterSize {
+		// Mark the rest of the cluster as deleted so that it
+		// does not end the directory.
+		if offset < clusterSize {
+			markDeleted(cluster[offset:])
+			err := d.Chain.writeSectors(cluster, offset/SectorSize, clusterSize/SectorSize-1)
+			if err != nil {
+				return err
+			}
+		}
+		cluster = make([]byte, clusterSize)
+		copy(cluster, encoded)
+		return d.Chain.ExtendWith(cluster)
+	}
+	copy(cluster[offset:], encoded)
+	return d.Chain.writeSectors(cluster, offset/SectorSize, (offset+len(encoded)-1)/SectorSize)
+}
+
+// Lookup finds the entry with a given name.
+//
+// The name is compared case-insensitively against both
+// the long name and the formatted short name of each
+// entry, so "foo.txt" matches "FOO.TXT".
+// The "." and ".." entries are never matched.
+//
+// If no entry is found, ErrNotExist is returned.
+func (d *Dir) Lookup(name string) (DirEntry, error) {
+	entry, _, err := d.lookup(name)
+	return entry, err
+}
+
+func (d *Dir) lookup(name string) (DirEntry, rawLocation, error) {
+	entries, locs, err := d.readDir()
+	if err != nil {
+		return nil, rawLocation{}, essentials.AddCtx("Lookup", err)
+	}
+	for i, entry := range entries {
+		if !entry.Raw().IsDotPointer() && entry.matchesName(name) {
+			return entry, locs[i], nil
+		}
+	}
+	return nil, rawLocation{}, os.ErrNotExist
 }
 
 // RemoveEntry deletes the entry for the given name.
@@ -133,7 +266,204 @@ func (d *Dir) RemoveEntry(name string) (entry DirEntry, err error) {
 	return nil, os.ErrNotExist
 }
 
+// isDirEnd checks if a free entry starting with 0x00, at
+// offset i in a cluster of a directory, is the end of the
+// directory.
+//
+// Older versions of this package padded the end of a
+// non-final cluster with zeros when the next entry did not
+// fit in it, so zeros which fill the rest of a non-final
+// cluster after at least one entry are not the end.
+func isDirEnd(cluster []byte, i int, lastCluster bool) bool {
+	if lastCluster || i == 0 {
+		return true
+	}
+	for _, b := range cluster[i:] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// markDeleted marks every entry in data as deleted.
+func markDeleted(data []byte) {
+	for i := 0; i < len(data); i += 32 {
+		data[i] = 0xe5
+	}
+}
+
 // AddRawEntry adds a raw directory entry.
 func (d *Dir) AddRawEntry(entry *RawDirEntry) error {
 	return d.AddEntry(DirEntry{entry})
 }
+
+// FindFreeSlots finds count consecutive free entries in a
+// directory chain, extending the directory if necessary.
+//
+// Entries starting with 0xE5 are free.
+// Since an entry starting with 0x00 marks the end of a
+// directory, it and all the entries after it are free.
+// A run of free entries may span multiple clusters,
+// including clusters added by extending the directory.
+//
+// The first entry in the run is located by its cluster
+// offset in the chain and its index within that cluster.
+func (f *FS) FindFreeSlots(dir *Chain, count int) (clusterOffset int64, entryIndex int, err error) {
+	defer essentials.AddCtxTo("FindFreeSlots", &err)
+	if count <= 0 {
+		return 0, 0, errors.New("invalid slot count")
+	}
+	if _, err := dir.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	perCluster := int64(f.ClusterSize() / 32)
+
+	var index, runStart int64
+	var runLength int
+	var ended bool
+	r := newFATReader(f)
+	for dir.cluster != 0 {
+		cluster, done, err := dir.readNext(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := 0; i < len(cluster); i += 32 {
+			if cluster[i] == 0 && !ended && isDirEnd(cluster, i, done) {
+				ended = true
+			}
+			if ended || cluster[i] == 0xe5 || cluster[i] == 0 {
+				if runLength == 0 {
+					runStart = index
+				}
+				runLength++
+				if runLength == count {
+					return runStart / perCluster, int(runStart % perCluster), nil
+				}
+			} else {
+				runLength = 0
+			}
+			index++
+		}
+		if done {
+			break
+		}
+	}
+
+	if runLength == 0 {
+		runStart = index
+	}
+	for runLength < count {
+		if err := dir.Extend(); err != nil {
+			return 0, 0, err
+		}
+		if err := dir.WriteCluster(make([]byte, f.ClusterSize())); err != nil {
+			return 0, 0, err
+		}
+		runLength += int(perCluster)
+	}
+	return runStart / perCluster, int(runStart % perCluster), nil
+}
+
+// CompactDir rewrites a directory without its deleted
+// entries, packing the remaining entries together and
+// freeing any clusters at the end of the chain which are
+// no longer needed.
+//
+// The order of the entries is preserved, so "." and ".."
+// stay first.
+// Long name entries are kept with their short entry, and
+// long name entries whose short entry has been deleted
+// are dropped.
+func (f *FS) CompactDir(dir *Chain) (err error) {
+	defer essentials.AddCtxTo("CompactDir", &err)
+	d := NewDir(dir)
+	entries, _, err := d.readDir()
+	if err != nil {
+		return err
+	}
+	return d.WriteDir(entries)
+}
+
+// An InvalidEntryAction is how RepairInvalidEntries fixes
+// an entry with an invalid first cluster.
+type InvalidEntryAction int
+
+const (
+	// ZeroInvalid turns a file into an empty file, with
+	// first cluster 0 and size 0.
+	ZeroInvalid InvalidEntryAction = iota
+
+	// DeleteInvalid removes the entry.
+	DeleteInvalid
+)
+
+// ZeroInvalidEntries is like RepairInvalidEntries with
+// the ZeroInvalid action.
+func (f *FS) ZeroInvalidEntries(dir *Chain) (int, error) {
+	return f.RepairInvalidEntries(dir, ZeroInvalid)
+}
+
+// RepairInvalidEntries fixes the entries in a directory
+// whose first cluster is invalid, and returns the number
+// of entries that were fixed.
+//
+// An entry's first cluster is invalid if it is 1, if it
+// is NumClusters() or more, or if it is free or marked bad
+// in the FAT.
+// A first cluster of 0 is only valid for an empty file.
+// The "." and ".." entries and the volume label are never
+// changed.
+//
+// Directory entries are always deleted, since a directory
+// must have a cluster.
+// If any entries are fixed, the directory is rewritten as
+// with WriteDir.
+func (f *FS) RepairInvalidEntries(dir *Chain, action InvalidEntryAction) (count int, err error) {
+	defer essentials.AddCtxTo("RepairInvalidEntries", &err)
+	d := NewDir(dir)
+	entries, _, err := d.readDir()
+	if err != nil {
+		return 0, err
+	}
+	var result []DirEntry
+	for _, entry := range entries {
+		raw := entry.Raw()
+		if raw.IsDotPointer() || raw.Attr()&VolumeID != 0 {
+			result = append(result, entry)
+			continue
+		}
+		valid, err := f.validFirstCluster(raw)
+		if err != nil {
+			return 0, err
+		}
+		if valid {
+			result = append(result, entry)
+			continue
+		}
+		count++
+		if action == ZeroInvalid && !raw.IsDir() {
+			raw.SetFirstCluster(0)
+			raw.SetFileSize(0)
+			result = append(result, entry)
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, d.WriteDir(result)
+}
+
+func (f *FS) validFirstCluster(raw *RawDirEntry) (bool, error) {
+	cluster := raw.FirstCluster()
+	if cluster == 0 {
+		return !raw.IsDir() && raw.FileSize() == 0, nil
+	} else if cluster < 2 || cluster >= f.NumClusters() {
+		return false, nil
+	}
+	contents, err := f.ReadFAT(cluster)
+	if err != nil {
+		return false, err
+	}
+	return contents != 0 && contents != badCluster, nil
+}
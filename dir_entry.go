@@ -1,7 +1,11 @@
 package fatfs
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/unixpickle/essentials"
 )
@@ -17,8 +21,15 @@ func NewDirEntry(name string, cluster, size uint32, date time.Time, dir bool) Di
 }
 
 // WrapDirEntry creates a DirEntry around a RawDirEntry.
+//
+// No long name is added if the short name can represent
+// the name exactly.
+// This includes names like "readme.txt" whose base name or
+// extension is all lowercase, for which the LowerCaseBase
+// and LowerCaseExt flags are set in NTRes.
 func WrapDirEntry(name string, short *RawDirEntry) DirEntry {
-	if name == UnformatName(string(short.Name())) {
+	if flags, ok := shortNameCaseFlags(name, short); ok {
+		short.SetNTRes(short.NTRes()&^(LowerCaseBase|LowerCaseExt) | flags)
 		return DirEntry{short}
 	}
 	checksum := shortNameChecksum(short.Name())
@@ -40,6 +51,137 @@ func WrapDirEntry(name string, short *RawDirEntry) DirEntry {
 	return append(parts, short)
 }
 
+// shortNameCaseFlags checks if a short entry can stand
+// for a name without a long name, with the base name and
+// the extension each in either all uppercase or all
+// lowercase.
+// If so, it returns the case flags for the name.
+//
+// Only ASCII names qualify, since case mapping of other
+// characters does not round-trip through a short name.
+func shortNameCaseFlags(name string, short *RawDirEntry) (flags uint8, ok bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			return 0, false
+		}
+	}
+	base, ext := name, ""
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		base, ext = name[:idx], name[idx+1:]
+	}
+	for _, part := range []struct {
+		str  string
+		flag uint8
+	}{{base, LowerCaseBase}, {ext, LowerCaseExt}} {
+		if part.str == strings.ToUpper(part.str) {
+			continue
+		} else if part.str == strings.ToLower(part.str) {
+			flags |= part.flag
+		} else {
+			return 0, false
+		}
+	}
+	candidate := *short
+	candidate.SetNTRes(candidate.NTRes()&^(LowerCaseBase|LowerCaseExt) | flags)
+	if (DirEntry{&candidate}).ShortNameString() != name {
+		return 0, false
+	}
+	return flags, true
+}
+
+// ValidateName checks that a name can be used for a new
+// file or directory.
+//
+// A valid name is not empty, "." or "..", fits in 255
+// UTF-16 code units, and contains no control characters
+// or any of the characters \ / : * ? " < > |.
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("name is reserved: %q", name)
+	}
+	if n := len(utf16.Encode([]rune(name))); n > 255 {
+		return fmt.Errorf("name is too long: %d UTF-16 units (maximum 255)", n)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("name contains control character %#x", r)
+		}
+		if strings.ContainsRune("\\/:*?\"<>|", r) {
+			return fmt.Errorf("name contains forbidden character %q", r)
+		}
+	}
+	return nil
+}
+
+// matchesName checks if a name refers to the entry, as in
+// Dir.Lookup.
+func (d DirEntry) matchesName(name string) bool {
+	return strings.EqualFold(d.Name(), name) ||
+		strings.EqualFold(UnformatName(string(d.Raw().Name())), name)
+}
+
+// A shortNameSet is the set of raw short names used in a
+// directory, for giving new entries unique short names.
+type shortNameSet struct {
+	names map[string]bool
+
+	// nextTail maps a short name to the first numeric tail
+	// that might still be free for it.
+	nextTail map[string]int
+}
+
+// shortNamesOf gets the short names used by a directory
+// listing, not including the volume label.
+func shortNamesOf(listing []DirEntry) *shortNameSet {
+	res := &shortNameSet{names: map[string]bool{}, nextTail: map[string]int{}}
+	for _, entry := range listing {
+		if entry.Raw().Attr()&VolumeID == 0 {
+			res.names[string(entry.Raw().Name())] = true
+		}
+	}
+	return res
+}
+
+// unique makes sure that an entry's short name is not in
+// the set, and then adds it to the set.
+//
+// If the short name is taken, a numeric tail is added to
+// it, as in "FOO~1", and the entry is rebuilt with a long
+// name.
+func (s *shortNameSet) unique(name string, entry DirEntry) (DirEntry, error) {
+	short := *entry.Raw()
+	original := string(short.Name())
+	if !s.names[original] {
+		s.names[original] = true
+		return entry, nil
+	}
+	base := strings.TrimRight(original[:8], " ")
+	ext := original[8:]
+	n := s.nextTail[original]
+	if n == 0 {
+		n = 1
+	}
+	for ; n < 1000000; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		prefix := base
+		if len(prefix)+len(tail) > 8 {
+			prefix = prefix[:8-len(tail)]
+		}
+		candidate := spacePad(prefix+tail, 8) + ext
+		if !s.names[candidate] {
+			s.names[candidate] = true
+			s.nextTail[original] = n + 1
+			copy(short.Name(), candidate)
+			short.SetNTRes(short.NTRes() &^ (LowerCaseBase | LowerCaseExt))
+			return WrapDirEntry(name, &short), nil
+		}
+	}
+	return nil, errors.New("no unique short name is available")
+}
+
 // Raw gets the short entry corresponding to this entry.
 // This can be used for all attributes besides the name.
 func (d DirEntry) Raw() *RawDirEntry {
@@ -47,10 +189,11 @@ func (d DirEntry) Raw() *RawDirEntry {
 }
 
 // Name gets the name of the directory entry. This may be
-// the short name if no long name is present.
+// the short name if no long name is present, as formatted
+// by ShortNameString.
 func (d DirEntry) Name() string {
 	if len(d) == 1 {
-		return UnformatName(string(d[0].Name()))
+		return d.ShortNameString()
 	}
 	var words []uint16
 	for i := len(d) - 2; i >= 0; i-- {
@@ -59,6 +202,33 @@ func (d DirEntry) Name() string {
 	return string(wordsToRunes(words))
 }
 
+// ShortNameString formats the short name of the entry as
+// a conventional name like "README.TXT".
+//
+// Some systems store names which are all lowercase, such
+// as "readme.txt", without a long name, and instead set
+// the LowerCaseBase and LowerCaseExt flags in NTRes.
+// These flags are applied to the result.
+func (d DirEntry) ShortNameString() string {
+	raw := d.Raw()
+	base := strings.TrimRight(string(raw.Name()[:8]), " ")
+	ext := strings.TrimRight(string(raw.Name()[8:]), " ")
+	if strings.HasPrefix(base, "\x05") {
+		// 0x05 stands in for a leading 0xE5 byte.
+		base = "\xe5" + base[1:]
+	}
+	if raw.NTRes()&LowerCaseBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if raw.NTRes()&LowerCaseExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
 func unpackLongEntry(raw *RawDirEntry) []uint16 {
 	var res []uint16
 	for _, byteRange := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
@@ -99,20 +269,16 @@ func packLongEntry(data []uint16, idx int, last bool, checksum uint8) *RawDirEnt
 	return &res
 }
 
+// wordsToRunes decodes UTF-16, as used in long names,
+// including surrogate pairs.
 func wordsToRunes(words []uint16) []rune {
-	var res []rune
-	for _, word := range words {
-		res = append(res, rune(word))
-	}
-	return res
+	return utf16.Decode(words)
 }
 
+// runesToWords encodes runes as UTF-16, using surrogate
+// pairs for runes outside the Basic Multilingual Plane.
 func runesToWords(runes []rune) []uint16 {
-	var res []uint16
-	for _, r := range runes {
-		res = append(res, uint16(r))
-	}
-	return res
+	return utf16.Encode(runes)
 }
 
 func shortNameChecksum(name []byte) uint8 {
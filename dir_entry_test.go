@@ -1,13 +1,127 @@
 package fatfs
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestLongName(t *testing.T) {
-	entry := NewDirEntry("this is a long name", 0, 13, time.Now(), false)
-	if entry.Name() != "this is a long name" {
-		t.Error("unexpected name:", entry.Name())
+	for _, name := range []string{"this is a long name", "smile 😀.txt",
+		strings.Repeat("😀", 127)} {
+		entry := NewDirEntry(name, 0, 13, time.Now(), false)
+		if entry.Name() != name {
+			t.Errorf("expected %q but got %q", name, entry.Name())
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"foo.txt", "FOO", "with spaces.tar.gz", "日本語.txt",
+		strings.Repeat("a", 255), "😀.txt"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "a\\b", "what?", "star*", "a:b",
+		"\"quoted\"", "<a>", "a|b", "tab\t", "nul\x00", strings.Repeat("a", 256),
+		strings.Repeat("😀", 128)} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	if _, err := Mkdir(root, "a/b", time.Now()); err == nil {
+		t.Error("expected Mkdir error")
+	}
+	if _, err := CreateFile(root, "", strings.NewReader("hi"), time.Now()); err == nil {
+		t.Error("expected CreateFile error")
+	}
+	if entries, err := root.ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("expected no entries but got %d", len(entries))
+	}
+}
+
+func TestShortNameString(t *testing.T) {
+	entry := NewDirEntry("README.TXT", 0, 0, time.Now(), false)
+	for flags, expected := range map[uint8]string{
+		0:                            "README.TXT",
+		LowerCaseBase:                "readme.TXT",
+		LowerCaseExt:                 "README.txt",
+		LowerCaseBase | LowerCaseExt: "readme.txt",
+	} {
+		entry.Raw().SetNTRes(flags)
+		if actual := entry.ShortNameString(); actual != expected {
+			t.Errorf("flags %#x: expected %q but got %q", flags, expected, actual)
+		}
+	}
+
+	entry = NewDirEntry("MAKEFILE", 0, 0, time.Now(), false)
+	entry.Raw().SetNTRes(LowerCaseBase | LowerCaseExt)
+	if actual := entry.ShortNameString(); actual != "makefile" {
+		t.Errorf("expected makefile but got %q", actual)
+	}
+
+	long := NewDirEntry("My Long Name.txt", 0, 0, time.Now(), false)
+	if actual := long.ShortNameString(); actual != "MY LONG.TXT" {
+		t.Errorf("unexpected short name %q", actual)
+	}
+}
+
+func TestDirEntryCaseFlags(t *testing.T) {
+	for name, expected := range map[string]uint8{
+		"README.TXT": 0,
+		"readme.txt": LowerCaseBase | LowerCaseExt,
+		"README.txt": LowerCaseExt,
+		"readme.TXT": LowerCaseBase,
+		"makefile":   LowerCaseBase,
+		"123.txt":    LowerCaseExt,
+	} {
+		entry := NewDirEntry(name, 0, 0, time.Now(), false)
+		if len(entry) != 1 {
+			t.Errorf("%s: unexpected long name", name)
+		} else if entry.Raw().NTRes() != expected {
+			t.Errorf("%s: expected flags %#x but got %#x", name, expected, entry.Raw().NTRes())
+		} else if entry.Name() != name {
+			t.Errorf("%s: got name %q", name, entry.Name())
+		}
+	}
+	for _, name := range []string{"ReadMe.txt", "readme.Txt", "long name.txt", "\u017f", "\u0131",
+		"\u00e9.txt", "\u00c9.TXT"} {
+		entry := NewDirEntry(name, 0, 0, time.Now(), false)
+		if len(entry) == 1 {
+			t.Errorf("%s: expected long name", name)
+		} else if entry.Raw().NTRes() != 0 {
+			t.Errorf("%s: unexpected flags %#x", name, entry.Raw().NTRes())
+		}
+		if entry.Name() != name {
+			t.Errorf("%s: got name %q", name, entry.Name())
+		}
+	}
+
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	if _, err := CreateFile(root, "readme.txt", strings.NewReader("hi"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if listing, err := root.ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 1 || len(listing[0]) != 1 || listing[0].Name() != "readme.txt" {
+		t.Errorf("unexpected listing: %v", listing)
+	}
+	if err := Remove(root, "readme.txt"); err != nil {
+		t.Fatal(err)
 	}
 }
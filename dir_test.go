@@ -1,7 +1,10 @@
 package fatfs
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,3 +77,488 @@ func TestRemoveEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestAddEntryWrites(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(RootDirChain(fs))
+	var writes []uint32
+	fs.OnSectorWrite = func(sector uint32) {
+		writes = append(writes, sector)
+	}
+
+	for i := 0; i < 5; i++ {
+		writes = nil
+		name := fmt.Sprintf("a rather long file name number %d.txt", i)
+		if err := dir.AddEntry(NewDirEntry(name, 0, 0, time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) != 1 && (len(writes) != 2 || writes[1] != writes[0]+1) {
+			t.Errorf("entry %d: unexpected writes %v", i, writes)
+		}
+	}
+
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 5 {
+		t.Fatalf("unexpected length: %d", len(listing))
+	}
+	for i, entry := range listing {
+		name := fmt.Sprintf("a rather long file name number %d.txt", i)
+		if entry.Name() != name {
+			t.Errorf("expected name %s but got %s", name, entry.Name())
+		}
+	}
+}
+
+func TestRelocatedRootDir(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootCluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewChain(fs, rootCluster).WriteCluster(make([]byte, fs.ClusterSize())); err != nil {
+		t.Fatal(err)
+	}
+	fs.BootSector.SetRootClus(rootCluster)
+
+	dir := NewDir(fs.RootDir())
+	for i := 0; i < 300; i++ {
+		entry := NewDirEntry(fmt.Sprintf("%d.TXT", i), 0, 0, time.Now(), false)
+		if err := dir.AddEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir.Chain.FirstCluster() != rootCluster {
+		t.Errorf("expected root cluster %d but got %d", rootCluster, dir.Chain.FirstCluster())
+	}
+	if length, err := dir.Chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if length == 0 {
+		t.Error("expected root directory to span multiple clusters")
+	}
+
+	listing, err := NewDir(fs.RootDir()).ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 300 {
+		t.Errorf("unexpected length: %d", len(listing))
+	}
+}
+
+func TestFindFreeSlots(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := RootDirChain(fs)
+
+	cluster := make([]byte, fs.ClusterSize())
+	for i := range cluster {
+		cluster[i] = 'A'
+	}
+	numEntries := len(cluster) / 32
+	for _, idx := range []int{3, 4, numEntries - 2, numEntries - 1} {
+		cluster[idx*32] = 0xe5
+	}
+	if err := chain.WriteCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(count int, expCluster int64, expIndex int) {
+		clusterOffset, entryIndex, err := fs.FindFreeSlots(chain, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clusterOffset != expCluster || entryIndex != expIndex {
+			t.Errorf("count %d: expected (%d, %d) but got (%d, %d)", count,
+				expCluster, expIndex, clusterOffset, entryIndex)
+		}
+	}
+
+	check(2, 0, 3)
+	check(3, 0, numEntries-2)
+	if n, err := chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 2 clusters but got %d", n+1)
+	}
+	check(numEntries+3, 0, numEntries-2)
+	if n, _ := chain.Seek(0, io.SeekEnd); n != 2 {
+		t.Fatalf("expected 3 clusters but got %d", n+1)
+	}
+
+	// Everything after a 0x00 entry is free.
+	cluster[10*32] = 0
+	if _, err := chain.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.WriteCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	check(5, 0, 10)
+}
+
+func TestCompactDir(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := Mkdir(NewDir(fs.RootDir()), "sub", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		entry := NewDirEntry(fmt.Sprintf("long file name %d.txt", i), 0, 0, time.Now(), false)
+		if err := dir.AddEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldLength, err := dir.Chain.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the short entries of most files, leaving
+	// their long name entries behind.
+	_, locs, err := dir.readDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i, loc := range locs[2:] {
+		if i%10 != 0 {
+			cluster, err := dir.Chain.ReadClusterAt(loc.cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cluster[loc.offset] = 0xe5
+			if err := dir.Chain.WriteClusterAt(loc.cluster, cluster); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			expected = append(expected, fmt.Sprintf("long file name %d.txt", i))
+		}
+	}
+
+	if err := fs.CompactDir(dir.Chain); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected)+2 {
+		t.Fatalf("expected %d entries but got %d", len(expected)+2, len(entries))
+	}
+	if entries[0].Name() != "." || entries[1].Name() != ".." {
+		t.Error("dot entries were not kept first")
+	}
+	for i, name := range expected {
+		if actual := entries[i+2].Name(); actual != name {
+			t.Errorf("entry %d: expected %q but got %q", i, name, actual)
+		}
+	}
+	newLength, err := dir.Chain.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newLength != 0 || oldLength == 0 {
+		t.Errorf("expected chain to shrink to one cluster, but went from %d to %d",
+			oldLength+1, newLength+1)
+	}
+}
+
+func TestAddEntryOrdering(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(RootDirChain(fs))
+	for i := 0; i < 14; i++ {
+		name := fmt.Sprintf("FILE%d.TXT", i)
+		if err := dir.AddEntry(NewDirEntry(name, 0, 0, time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// This entry spans the first two sectors.
+	var writes []uint32
+	fs.OnSectorWrite = func(sector uint32) {
+		writes = append(writes, sector)
+	}
+	longName := "a rather long file name.txt"
+	if err := dir.AddEntry(NewDirEntry(longName, 0, 0, time.Now(), false)); err != nil {
+		t.Fatal(err)
+	}
+	firstData, _ := fs.DataRegion()
+	if len(writes) != 2 || writes[0] != firstData || writes[1] != firstData+1 {
+		t.Errorf("unexpected writes: %v", writes)
+	}
+
+	// Simulate a crash which only wrote the long name
+	// entries, and make sure the directory is still usable.
+	dev[int(firstData+1)*SectorSize+32] = 0
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 14 {
+		t.Errorf("expected 14 entries but got %d", len(listing))
+	}
+	if err := dir.AddEntry(NewDirEntry(longName, 0, 0, time.Now(), false)); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := dir.Lookup(longName); err != nil {
+		t.Fatal(err)
+	} else if entry.Name() != longName {
+		t.Errorf("unexpected name: %s", entry.Name())
+	}
+
+	// Fill the cluster, and check that the FAT is only
+	// linked to a new cluster once its data is written.
+	fs.OnSectorWrite = nil
+	for i := 14; i < 200; i++ {
+		name := fmt.Sprintf("FILE%d.TXT", i)
+		writes = nil
+		fs.OnSectorWrite = func(sector uint32) {
+			writes = append(writes, sector)
+		}
+		if err := dir.AddEntry(NewDirEntry(name, 0, 0, time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) > 1 {
+			last := writes[len(writes)-1]
+			if last >= firstData {
+				t.Errorf("expected FAT write last but got %v", writes)
+			}
+			break
+		}
+	}
+}
+
+func TestReadDirDeletedRuns(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	entry := func(name string) []byte {
+		return NewDirEntry(name, 0, 0, time.Now(), false).Raw()[:]
+	}
+	deleted := func(name string) []byte {
+		res := entry(name)
+		res[0] = 0xe5
+		return res
+	}
+
+	// Thousands of deleted entries, then a live entry, then
+	// the end marker and stale data which must be ignored.
+	var data []byte
+	for i := 0; i < 3000; i++ {
+		data = append(data, deleted(fmt.Sprintf("OLD%d.TXT", i))...)
+	}
+	data = append(data, entry("LIVE.TXT")...)
+	data = append(data, make([]byte, 32)...)
+	data = append(data, entry("STALE.TXT")...)
+	data = append(data, make([]byte, clusterSize-len(data)%clusterSize)...)
+	data = append(data, entry("STALE2.TXT")...)
+	data = append(data, make([]byte, clusterSize-32)...)
+	var clusters [][]byte
+	for i := 0; i < len(data); i += clusterSize {
+		clusters = append(clusters, data[i:i+clusterSize])
+	}
+	chain := RootDirChain(fs)
+	if err := chain.SetClusters(clusters); err != nil {
+		t.Fatal(err)
+	}
+	lastCluster, err := chain.LastCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstData, _ := fs.DataRegion()
+	lastSector := firstData + (lastCluster-2)*uint32(fs.BootSector.SecPerClus())
+	fs.OnSectorRead = func(sector uint32) {
+		if sector == lastSector {
+			t.Error("read cluster after the end of the directory")
+		}
+	}
+
+	listing, err := NewDir(RootDirChain(fs)).ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Name() != "LIVE.TXT" {
+		t.Errorf("unexpected listing: %v", listing)
+	}
+}
+
+func TestReadDirOldPadding(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	entry := func(name string) []byte {
+		return NewDirEntry(name, 0, 0, time.Now(), false).Raw()[:]
+	}
+
+	// Older versions left zeros at the end of a cluster
+	// when the next entry did not fit.
+	first := make([]byte, clusterSize)
+	copy(first, entry("A.TXT"))
+	copy(first[32:], entry("B.TXT"))
+	second := make([]byte, clusterSize)
+	copy(second, entry("C.TXT"))
+	chain := RootDirChain(fs)
+	if err := chain.SetClusters([][]byte{first, second}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := NewDir(RootDirChain(fs))
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range listing {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "A.TXT,B.TXT,C.TXT" {
+		t.Errorf("unexpected listing: %v", names)
+	}
+
+	clusterOffset, entryIndex, err := fs.FindFreeSlots(RootDirChain(fs), clusterSize/32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusterOffset != 1 || entryIndex != 1 {
+		t.Errorf("expected free slots at (1, 1) but got (%d, %d)", clusterOffset, entryIndex)
+	}
+}
+
+func TestWriteDirPadding(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(RootDirChain(fs))
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("a long file name %d.txt", i)
+		if err := dir.AddEntry(NewDirEntry(name, 0, 0, time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 100 {
+		t.Fatalf("expected 100 entries but got %d", len(listing))
+	}
+	if err := dir.WriteDir(listing[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if listing, err = dir.ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 99 {
+		t.Errorf("expected 99 entries but got %d", len(listing))
+	}
+}
+
+func TestRepairInvalidEntries(t *testing.T) {
+	for _, action := range []InvalidEntryAction{ZeroInvalid, DeleteInvalid} {
+		dev := make(RAMDisk, 4096*80000)
+		fs, err := FormatFS(dev, "FOO", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := fs.MkdirAll("dir", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		good, err := CreateFile(dir, "good.txt", bytes.NewReader([]byte("hi")), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.WriteFAT(600, badCluster); err != nil {
+			t.Fatal(err)
+		}
+		invalid := map[string]uint32{
+			"free.txt":  500,
+			"bad.txt":   600,
+			"range.txt": fs.NumClusters(),
+			"one.txt":   1,
+			"sized.txt": 0,
+		}
+		for name, cluster := range invalid {
+			entry := NewDirEntry(name, cluster, 10, time.Now(), false)
+			if err := dir.AddEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries := []DirEntry{
+			NewDirEntry("empty.txt", 0, 0, time.Now(), false),
+			NewDirEntry("good2.txt", good.Chain.FirstCluster(), 2, time.Now(), false),
+			NewDirEntry("baddir", 700, 0, time.Now(), true),
+		}
+		for _, entry := range entries {
+			if err := dir.AddEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		count, err := fs.RepairInvalidEntries(dir.Chain, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(invalid)+1 {
+			t.Errorf("expected %d fixes but got %d", len(invalid)+1, count)
+		}
+		listing, err := dir.ReadDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		for _, entry := range listing {
+			names[entry.Name()] = true
+			if _, ok := invalid[entry.Name()]; ok {
+				if entry.Raw().FirstCluster() != 0 || entry.Raw().FileSize() != 0 {
+					t.Errorf("%s was not zeroed", entry.Name())
+				}
+			}
+		}
+		expectedLen := 5
+		if action == ZeroInvalid {
+			expectedLen += len(invalid)
+		}
+		if len(listing) != expectedLen || !names["good.txt"] || !names["good2.txt"] ||
+			!names["empty.txt"] || names["baddir"] {
+			t.Errorf("action %d: unexpected listing %v", action, listing)
+		}
+		if count, err := fs.ZeroInvalidEntries(dir.Chain); err != nil || count != 0 {
+			t.Errorf("expected no more fixes, got (%d, %v)", count, err)
+		}
+	}
+}
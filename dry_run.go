@@ -0,0 +1,172 @@
+package fatfs
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A SectorWrite is a sector write recorded during a dry
+// run.
+type SectorWrite struct {
+	Sector uint32
+
+	// Intent is the region of the volume being written:
+	// "reserved", "FAT", or "data".
+	Intent string
+}
+
+// A DryRunLog records the writes made to an FS during a
+// dry run.
+//
+// While a dry run is active, writes are buffered in
+// memory and are visible to subsequent reads, but they
+// are not applied to the underlying device.
+type DryRunLog struct {
+	fs       *FS
+	overlay  *overlayDevice
+	writes   []SectorWrite
+	done     bool
+	fatCache []*Sector
+
+	// These are copies of the rest of the FS's state from
+	// before the dry run, which writes may change.
+	refCounts   []uint8
+	bootSector  BootSector
+	allocCursor uint32
+	dirty       bool
+	closed      bool
+}
+
+// BeginDryRun starts buffering all writes to the FS.
+//
+// The dry run must be ended with Discard or Commit.
+// The FS's Device should not be modified until then.
+func (f *FS) BeginDryRun() *DryRunLog {
+	log := &DryRunLog{
+		fs:          f,
+		bootSector:  *f.BootSector,
+		allocCursor: f.allocCursor,
+		dirty:       f.dirty,
+		closed:      f.closed,
+	}
+	if f.fatCache != nil {
+		log.fatCache = f.fatCache
+		f.fatCacheShared = true
+	}
+	if f.refCounts != nil {
+		log.refCounts = append([]uint8{}, f.refCounts...)
+	}
+	log.overlay = newOverlayDevice(f.Device, func(idx uint32) {
+		log.writes = append(log.writes, SectorWrite{Sector: idx, Intent: f.sectorIntent(idx)})
+	})
+	f.Device = log.overlay
+	return log
+}
+
+// Writes returns every write made during the dry run in
+// the order they were performed.
+// A sector which is written twice appears twice.
+func (d *DryRunLog) Writes() []SectorWrite {
+	return append([]SectorWrite{}, d.writes...)
+}
+
+// Discard ends the dry run and drops all of the buffered
+// writes.
+func (d *DryRunLog) Discard() {
+	if d.done {
+		return
+	}
+	d.done = true
+	d.fs.Device = d.overlay.base
+	// Restore the in-memory state from before the dry run,
+	// since it may reflect discarded writes.
+	d.fs.fatCache = d.fatCache
+	d.fs.fatCacheShared = true
+	d.fs.refCounts = d.refCounts
+	*d.fs.BootSector = d.bootSector
+	d.fs.allocCursor = d.allocCursor
+	d.fs.dirty = d.dirty
+	d.fs.closed = d.closed
+}
+
+// Commit ends the dry run and applies all of the buffered
+// writes to the underlying device.
+func (d *DryRunLog) Commit() error {
+	if d.done {
+		return errors.New("Commit: dry run already ended")
+	}
+	d.done = true
+	d.fs.Device = d.overlay.base
+	return essentials.AddCtx("Commit", d.overlay.Flush())
+}
+
+func (f *FS) sectorIntent(idx uint32) string {
+	fatStart := uint32(f.BootSector.RsvdSecCnt())
+	if idx < fatStart {
+		return "reserved"
+	} else if idx < fatStart+uint32(len(f.fatSectors))*f.BootSector.FatSz32() {
+		return "FAT"
+	}
+	return "data"
+}
+
+// An overlayDevice buffers writes to a base device in
+// memory.
+type overlayDevice struct {
+	base    BlockDevice
+	sectors map[uint32]*Sector
+	onWrite func(idx uint32)
+}
+
+func newOverlayDevice(base BlockDevice, onWrite func(idx uint32)) *overlayDevice {
+	return &overlayDevice{
+		base:    base,
+		sectors: map[uint32]*Sector{},
+		onWrite: onWrite,
+	}
+}
+
+func (o *overlayDevice) NumSectors() uint32 {
+	return o.base.NumSectors()
+}
+
+func (o *overlayDevice) ReadSector(idx uint32) (*Sector, error) {
+	if sec, ok := o.sectors[idx]; ok {
+		res := *sec
+		return &res, nil
+	}
+	return o.base.ReadSector(idx)
+}
+
+func (o *overlayDevice) WriteSector(idx uint32, value *Sector) error {
+	if idx >= o.NumSectors() {
+		return errors.New("WriteSector: sector out of bounds")
+	}
+	sec := *value
+	o.sectors[idx] = &sec
+	if o.onWrite != nil {
+		o.onWrite(idx)
+	}
+	return nil
+}
+
+// Flush writes the buffered sectors to the base device
+// in ascending order.
+func (o *overlayDevice) Flush() error {
+	var indices []uint32
+	for idx := range o.sectors {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+	for _, idx := range indices {
+		if err := o.base.WriteSector(idx, o.sectors[idx]); err != nil {
+			return err
+		}
+		delete(o.sectors, idx)
+	}
+	return nil
+}
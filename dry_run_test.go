@@ -0,0 +1,124 @@
+package fatfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := fs.BeginDryRun()
+	if _, err := Mkdir(NewDir(RootDirChain(fs)), "DIR", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	intents := map[string]bool{}
+	for _, write := range log.Writes() {
+		intents[write.Intent] = true
+	}
+	if !intents["FAT"] || !intents["data"] || intents["reserved"] {
+		t.Errorf("unexpected write intents: %v", intents)
+	}
+	if listing, err := NewDir(RootDirChain(fs)).ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 1 {
+		t.Errorf("dry run writes should be visible, got %d entries", len(listing))
+	}
+	if n := countRootEntries(t, dev); n != 0 {
+		t.Errorf("device was modified during dry run (%d entries)", n)
+	}
+	log.Discard()
+	if _, ok := fs.Device.(RAMDisk); !ok {
+		t.Fatal("device was not restored")
+	}
+	if listing, err := NewDir(RootDirChain(fs)).ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 0 {
+		t.Errorf("discarded writes are still visible: %d entries", len(listing))
+	}
+
+	log = fs.BeginDryRun()
+	if _, err := Mkdir(NewDir(RootDirChain(fs)), "DIR", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRootEntries(t, dev); n != 1 {
+		t.Errorf("expected 1 committed entry but got %d", n)
+	}
+}
+
+func countRootEntries(t *testing.T, dev BlockDevice) int {
+	fs, err := NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := NewDir(RootDirChain(fs)).ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(listing)
+}
+
+func TestDryRunDiscardRefCounts(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.EnableCrossLinkCheck(); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]uint8{}, fs.refCounts...)
+
+	log := fs.BeginDryRun()
+	chain := NewChain(fs, 0)
+	for i := 0; i < 5; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Discard()
+
+	if !bytes.Equal(fs.refCounts, expected) {
+		t.Error("reference counts were not restored")
+	}
+}
+
+func TestDryRunDiscardState(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLabel := string(fs.BootSector.VolLab())
+	expectedCursor := fs.allocCursor
+
+	log := fs.BeginDryRun()
+	if err := fs.SetVolumeLabel("BAR"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log.Discard()
+
+	if string(fs.BootSector.VolLab()) != expectedLabel {
+		t.Error("boot sector was not restored")
+	}
+	if fs.allocCursor != expectedCursor {
+		t.Errorf("expected alloc cursor %d but got %d", expectedCursor, fs.allocCursor)
+	}
+	if _, err := fs.Alloc(); err != nil {
+		t.Error("FS is still closed:", err)
+	}
+}
@@ -0,0 +1,92 @@
+package fatfs
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/unixpickle/essentials"
+)
+
+// Equal checks if two file-systems have the same logical
+// contents.
+//
+// The file-systems are equal if they have the same paths,
+// and each path has the same attributes, size, creation
+// and modification times, and file contents in both.
+// Physical layout, such as where clusters are placed or
+// the order of directory entries, is ignored, as are short
+// names and last access dates.
+//
+// File contents are compared a cluster at a time, so files
+// are never buffered in memory.
+func (f *FS) Equal(other *FS) (equal bool, err error) {
+	defer essentials.AddCtxTo("Equal", &err)
+
+	otherEntries := map[string]DirEntry{}
+	err = other.AllEntries(func(path string, d DirEntry, loc EntryLocation) error {
+		otherEntries[path] = d
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	equal = true
+	numEntries := 0
+	err = f.AllEntries(func(path string, d DirEntry, loc EntryLocation) error {
+		numEntries++
+		otherEntry, ok := otherEntries[path]
+		if !ok || !sameMetadata(d.Raw(), otherEntry.Raw()) {
+			equal = false
+			return ErrStopWalk
+		}
+		if d.Raw().IsDir() {
+			return nil
+		}
+		same, err := sameContents(f, d.Raw(), other, otherEntry.Raw())
+		if err != nil {
+			return err
+		}
+		if !same {
+			equal = false
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return equal && numEntries == len(otherEntries), nil
+}
+
+func sameMetadata(r1, r2 *RawDirEntry) bool {
+	return r1.Attr() == r2.Attr() &&
+		r1.FileSize() == r2.FileSize() &&
+		r1.CrtTimeTenth() == r2.CrtTimeTenth() &&
+		r1.CrtTime() == r2.CrtTime() &&
+		r1.CrtDate() == r2.CrtDate() &&
+		r1.WrtTime() == r2.WrtTime() &&
+		r1.WrtDate() == r2.WrtDate()
+}
+
+func sameContents(fs1 *FS, r1 *RawDirEntry, fs2 *FS, r2 *RawDirEntry) (bool, error) {
+	size := int64(r1.FileSize())
+	file1 := NewFile(NewChain(fs1, r1.FirstCluster()), size)
+	file2 := NewFile(NewChain(fs2, r2.FirstCluster()), size)
+	buf1 := make([]byte, fs1.ClusterSize())
+	buf2 := make([]byte, len(buf1))
+	for {
+		n, err := io.ReadFull(file1, buf1)
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if _, err := io.ReadFull(file2, buf2[:n]); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(buf1[:n], buf2[:n]) {
+			return false, nil
+		}
+	}
+}
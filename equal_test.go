@@ -0,0 +1,95 @@
+package fatfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestEqual(t *testing.T) {
+	date := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	big := make([]byte, 100000)
+	rand.Read(big)
+	files := map[string][]byte{
+		"a.txt":               []byte("hello"),
+		"docs/Big File.bin":   big,
+		"docs/empty.txt":      nil,
+		"docs/nested/b.txt":   []byte("world"),
+		"other/long name.txt": []byte("long"),
+	}
+	order := []string{"docs/nested/b.txt", "a.txt", "docs/Big File.bin", "other/long name.txt",
+		"docs/empty.txt"}
+
+	build := func(paths []string, fragment bool) *FS {
+		dev := make(RAMDisk, 4096*80000)
+		fs, err := FormatFS(dev, "FOO", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := NewDir(fs.RootDir())
+		for _, path := range paths {
+			if fragment {
+				if _, err := CreateFile(root, "tmp", bytes.NewReader(make([]byte, 10000)),
+					date); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names, _ := CleanPath(path)
+			dir := root
+			for _, name := range names[:len(names)-1] {
+				if sub, err := dir.Lookup(name); err == nil {
+					dir = NewDir(NewChain(fs, sub.Raw().FirstCluster()))
+				} else if dir, err = Mkdir(dir, name, date); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := CreateFile(dir, names[len(names)-1], bytes.NewReader(files[path]),
+				date); err != nil {
+				t.Fatal(err)
+			}
+			if fragment {
+				if err := Remove(root, "tmp"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return fs
+	}
+
+	fs1 := build([]string{"a.txt", "docs/Big File.bin", "docs/empty.txt", "docs/nested/b.txt",
+		"other/long name.txt"}, false)
+	fs2 := build(order, true)
+	if equal, err := fs1.Equal(fs2); err != nil {
+		t.Fatal(err)
+	} else if !equal {
+		t.Error("expected file-systems to be equal")
+	}
+
+	fs3 := build(order, false)
+	file, err := fs3.OpenFile("docs/Big File.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{big[50000] + 1}, 50000); err != nil {
+		t.Fatal(err)
+	}
+	fs4 := build(order, false)
+	if err := fs4.ClearArchive("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fs5 := build(append(order, "extra.txt"), false)
+
+	for i, fs := range []*FS{fs3, fs4, fs5} {
+		if equal, err := fs1.Equal(fs); err != nil {
+			t.Fatal(err)
+		} else if equal {
+			t.Errorf("case %d: expected file-systems to differ", i)
+		}
+		if equal, err := fs.Equal(fs1); err != nil {
+			t.Fatal(err)
+		} else if equal {
+			t.Errorf("case %d: expected file-systems to differ in reverse", i)
+		}
+	}
+}
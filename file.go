@@ -0,0 +1,651 @@
+package fatfs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A File is an open handle to the contents of a regular
+// file.
+//
+// A File has a byte offset which is used by Read, Write,
+// and Seek.
+// Writes may change the file's size and first cluster.
+// If the File was opened with FS.OpenFile, writes record
+// these in its directory entry, along with the archive
+// attribute and a write timestamp from the FS clock.
+// Otherwise, it is up to the caller to record them.
+//
+// The cluster most recently read by ReadAt is cached, so
+// that many small reads within one cluster only read the
+// device once.
+// The cache is dropped when the File is written to, but
+// not if the chain is modified by other means, in which
+// case a new File should be created.
+//
+// ReadAt does not move Chain, so it may be called from
+// several goroutines at once, as long as the File is not
+// being written.
+type File struct {
+	Chain *Chain
+
+	// Size is the logical size of the file in bytes.
+	// The chain may contain more data than this, since
+	// the final cluster is usually only partially used.
+	Size int64
+
+	offset int64
+
+	// entryDir and entryLoc locate the file's short entry,
+	// or entryDir is nil if the entry is not known.
+	entryDir *Chain
+	entryLoc rawLocation
+
+	// cache is the contents of the cluster at offset
+	// cacheIdx in the chain, or nil if nothing is cached.
+	cacheLock sync.Mutex
+	cache     []byte
+	cacheIdx  int64
+
+	// readChain is a cursor into the chain that ReadAt
+	// can reuse, or nil if there is none.
+	readChain *Chain
+
+	// cacheGen is incremented whenever the cache is
+	// dropped, so that reads which were running at the
+	// time do not restore stale state.
+	cacheGen int64
+}
+
+// NewFile creates a File from a Chain and the file's
+// size, as recorded in its directory entry.
+func NewFile(c *Chain, size int64) *File {
+	return &File{Chain: c, Size: size}
+}
+
+// OpenChain creates a File from the first cluster and
+// size of a file, without looking up a directory entry.
+//
+// The first cluster may be 0 only if size is 0, since
+// empty files need not have any clusters.
+func (f *FS) OpenChain(firstCluster uint32, size int64) (*File, error) {
+	if size < 0 {
+		return nil, errors.New("OpenChain: negative size")
+	}
+	if firstCluster == 0 && size == 0 {
+		return NewFile(NewChain(f, 0), 0), nil
+	}
+	if firstCluster < 2 || firstCluster >= f.NumClusters() {
+		return nil, essentials.AddCtx("OpenChain", ErrInvalidCluster)
+	}
+	return NewFile(NewChain(f, firstCluster), size), nil
+}
+
+// ReadAt reads len(p) bytes starting at the byte offset
+// off in the file.
+//
+// This implements io.ReaderAt.
+// Reads never go past the logical size of the file.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("ReadAt: negative offset")
+	}
+	if off >= f.Size {
+		return 0, io.EOF
+	}
+	fs := f.Chain.FS()
+	clusterSize := int64(fs.ClusterSize())
+	clusterIdx := off / clusterSize
+	within := off % clusterSize
+	f.cacheLock.Lock()
+	cache, cacheIdx, gen := f.cache, f.cacheIdx, f.cacheGen
+	chain := f.readChain
+	f.readChain = nil
+	f.cacheLock.Unlock()
+	if chain == nil {
+		chain = NewChain(fs, f.Chain.FirstCluster())
+	}
+	defer f.putReadChain(chain, gen)
+	if cache != nil && cacheIdx == clusterIdx {
+		data := cache
+		if remaining := f.Size - off; remaining < clusterSize-within {
+			data = data[:within+remaining]
+		}
+		n = copy(p, data[within:])
+		if n == len(p) {
+			return n, nil
+		} else if off+int64(n) >= f.Size {
+			return n, io.EOF
+		}
+		clusterIdx++
+		within = 0
+	}
+	if newIdx, err := chain.Seek(clusterIdx, io.SeekStart); err != nil {
+		return n, essentials.AddCtx("ReadAt", err)
+	} else if newIdx != clusterIdx {
+		return n, essentials.AddCtx("ReadAt", io.ErrUnexpectedEOF)
+	}
+	r := newFATReader(fs)
+	for n < len(p) && off+int64(n) < f.Size {
+		data, done, err := chain.readNext(r)
+		if err != nil {
+			return n, essentials.AddCtx("ReadAt", err)
+		}
+		f.setCache(data, clusterIdx, gen)
+		clusterIdx++
+		if remaining := f.Size - (off + int64(n)); remaining < int64(len(data))-within {
+			data = data[:within+remaining]
+		}
+		n += copy(p[n:], data[within:])
+		within = 0
+		if done && n < len(p) && off+int64(n) < f.Size {
+			return n, essentials.AddCtx("ReadAt", io.ErrUnexpectedEOF)
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) setCache(data []byte, idx, gen int64) {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.cacheGen == gen {
+		f.cache, f.cacheIdx = data, idx
+	}
+}
+
+func (f *File) putReadChain(chain *Chain, gen int64) {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.cacheGen == gen {
+		f.readChain = chain
+	}
+}
+
+// dropCache drops the cache and read cursor, since the
+// chain is about to be modified.
+func (f *File) dropCache() {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	f.cache = nil
+	f.readChain = nil
+	f.cacheGen++
+}
+
+// Read reads from the current offset in the file.
+//
+// At or beyond the end of the file, it returns io.EOF.
+func (f *File) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+// WriteTo writes the rest of the file, starting at the
+// current offset, to w, and advances the offset.
+//
+// This implements io.WriterTo, so it is used by io.Copy.
+// Only one cluster is buffered at a time, so files of any
+// size can be copied in constant memory.
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	defer essentials.AddCtxTo("WriteTo", &err)
+	if f.offset >= f.Size {
+		return 0, nil
+	}
+	clusterSize := int64(f.Chain.FS().ClusterSize())
+	clusterIdx := f.offset / clusterSize
+	if newIdx, err := f.Chain.Seek(clusterIdx, io.SeekStart); err != nil {
+		return 0, err
+	} else if newIdx != clusterIdx {
+		return 0, io.ErrUnexpectedEOF
+	}
+	within := f.offset % clusterSize
+	buf := make([]byte, clusterSize)
+	r := newFATReader(f.Chain.FS())
+	for {
+		if err := f.Chain.readClusterInto(buf); err != nil {
+			return n, err
+		}
+		data := buf[within:]
+		if remaining := f.Size - f.offset; remaining < int64(len(data)) {
+			data = data[:remaining]
+		}
+		m, err := w.Write(data)
+		n += int64(m)
+		f.offset += int64(m)
+		if err != nil {
+			return n, err
+		} else if m < len(data) {
+			return n, io.ErrShortWrite
+		}
+		if f.offset >= f.Size {
+			return n, nil
+		}
+		within = 0
+		idx := int64(len(f.Chain.prev))
+		if newIdx, err := f.Chain.advance(1, r); err != nil {
+			return n, err
+		} else if newIdx == idx {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// Write writes to the current offset in the file.
+//
+// See WriteAt for how writes past the end of the file are
+// handled.
+func (f *File) Write(p []byte) (n int, err error) {
+	n, err = f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return
+}
+
+// ReadFrom writes all the data from r to the current
+// offset in the file.
+//
+// This implements io.ReaderFrom.
+// Unlike Chain.ReadFrom, the data need not start on a
+// cluster boundary, and Size is updated to account for
+// exactly the bytes that were read, so it can be recorded
+// in the file's directory entry as-is.
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	defer essentials.AddCtxTo("ReadFrom", &err)
+	defer func() {
+		if n > 0 {
+			if entryErr := f.recordEntry(); err == nil {
+				err = entryErr
+			}
+		}
+	}()
+	buffer := make([]byte, f.Chain.FS().ClusterSize())
+	for {
+		m, readErr := io.ReadFull(r, buffer)
+		if m > 0 {
+			written, err := f.writeAt(buffer[:m], f.offset)
+			f.offset += int64(written)
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return n, nil
+		} else if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+// Seek sets the byte offset for the next Read or Write.
+// It returns the new offset relative to the start of the
+// file.
+//
+// Seeking past the end of the file is allowed.
+// Reads from such an offset return io.EOF, and writes
+// extend the file, filling the gap with zeros.
+// Seeking to a negative offset is an error.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.Size
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek: negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// WriteAt writes len(p) bytes starting at the byte offset
+// off in the file.
+//
+// This implements io.WriterAt.
+// If the write goes past the end of the file, the chain
+// is extended and Size is increased.
+// If off is past the end of the file, the bytes between
+// the old end and off are zeroed.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	defer essentials.AddCtxTo("WriteAt", &err)
+	n, err = f.writeAt(p, off)
+	if len(p) > 0 {
+		if entryErr := f.recordEntry(); err == nil {
+			err = entryErr
+		}
+	}
+	return n, err
+}
+
+func (f *File) writeAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if end >= 1<<32 {
+		return 0, ErrTooLarge
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.dropCache()
+
+	// Bytes from start to off are zeros filling a gap.
+	start := off
+	if start > f.Size {
+		start = f.Size
+	}
+
+	clusterSize := int64(f.Chain.FS().ClusterSize())
+	oldLength, err := f.Chain.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if f.Chain.cluster != 0 {
+		oldLength++
+	}
+	for length := oldLength; length*clusterSize < end; length++ {
+		if err := f.Chain.Extend(); err != nil {
+			return 0, err
+		}
+	}
+
+	firstIdx := start / clusterSize
+	if _, err := f.Chain.Seek(firstIdx, io.SeekStart); err != nil {
+		return 0, err
+	}
+	for idx := firstIdx; idx*clusterSize < end; idx++ {
+		clusterStart := idx * clusterSize
+		clusterEnd := clusterStart + clusterSize
+		var data []byte
+		if idx < oldLength && (clusterStart < start || (end < clusterEnd && end < f.Size)) {
+			data, err = f.Chain.ReadCluster()
+			if err != nil {
+				return n, err
+			}
+		} else {
+			data = make([]byte, clusterSize)
+		}
+		zeroFrom := start
+		if zeroFrom < clusterStart {
+			zeroFrom = clusterStart
+		}
+		for pos := zeroFrom; pos < off && pos < clusterEnd; pos++ {
+			data[pos-clusterStart] = 0
+		}
+		copied := 0
+		if off < clusterEnd {
+			from := off
+			if from < clusterStart {
+				from = clusterStart
+			}
+			copied = copy(data[from-clusterStart:], p[from-off:])
+		}
+		if err := f.Chain.WriteCluster(data); err != nil {
+			return n, err
+		}
+		n += copied
+		newSize := end
+		if newSize > clusterEnd {
+			newSize = clusterEnd
+		}
+		if newSize > f.Size {
+			f.Size = newSize
+		}
+		if _, err := f.Chain.Seek(1, io.SeekCurrent); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Truncate changes the size of the file.
+//
+// If the file grows, the new bytes are zeros.
+// If it shrinks, clusters past the new end are freed, and
+// the chain becomes empty if no clusters are left.
+// If zeroSlack is true, the unused bytes at the end of the
+// final cluster are also zeroed, so that old data cannot
+// be read from the chain.
+func (f *File) Truncate(size int64, zeroSlack bool) (err error) {
+	defer essentials.AddCtxTo("Truncate", &err)
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	f.dropCache()
+	defer func() {
+		if entryErr := f.recordEntry(); err == nil {
+			err = entryErr
+		}
+	}()
+	if size > f.Size {
+		_, err := f.writeAt([]byte{0}, size-1)
+		return err
+	}
+	fs := f.Chain.FS()
+	clusterSize := int64(fs.ClusterSize())
+	numClusters := (size + clusterSize - 1) / clusterSize
+	if numClusters == 0 {
+		if err := f.Chain.Clear(false); err != nil {
+			return err
+		}
+		f.Size = 0
+		return nil
+	}
+
+	if _, err := f.Chain.Seek(numClusters-1, io.SeekStart); err != nil {
+		return err
+	}
+	next, err := fs.ReadFAT(f.Chain.cluster)
+	if err != nil {
+		return err
+	}
+	if next < EOF {
+		f.Chain.cache = nil
+		if err := fs.WriteFAT(f.Chain.cluster, EOF); err != nil {
+			return err
+		}
+		if err := NewChain(fs, next).Free(); err != nil {
+			return err
+		}
+	}
+	f.Size = size
+
+	if slackStart := int(size % clusterSize); zeroSlack && slackStart != 0 {
+		data, err := f.Chain.ReadCluster()
+		if err != nil {
+			return err
+		}
+		for i := slackStart; i < len(data); i++ {
+			data[i] = 0
+		}
+		return f.Chain.writeSectors(data, slackStart/SectorSize, len(data)/SectorSize-1)
+	}
+	return nil
+}
+
+// recordEntry records the file's size and first cluster
+// in its directory entry, if it is known, and marks the
+// entry as modified.
+func (f *File) recordEntry() error {
+	if f.entryDir == nil {
+		return nil
+	}
+	now := f.Chain.FS().now()
+	return updateEntryAt(f.entryDir, f.entryLoc, func(r *RawDirEntry) {
+		r.SetFirstCluster(f.Chain.FirstCluster())
+		r.SetFileSize(uint32(f.Size))
+		r.SetWrtDate(fatDate(now))
+		r.SetWrtTime(fatTime(now))
+		r.SetAttr(r.Attr() | Archive)
+	})
+}
+
+// Append writes the contents of r to the end of a file,
+// and then updates the file's directory entry with its new
+// size and a write timestamp from the FS clock.
+// The archive attribute is also set.
+//
+// The entry must be located in the directory entryChain.
+// It is modified in place, so the caller sees the update.
+//
+// Data is appended at the exact end of the file, even if
+// that is within a cluster.
+// If writing fails, the entry is still updated to include
+// any data that was appended.
+func (f *FS) Append(entry *DirEntry, entryChain *Chain, r io.Reader) (n int64, err error) {
+	defer essentials.AddCtxTo("Append", &err)
+	raw := entry.Raw()
+	entries, locs, err := NewDir(entryChain).readDir()
+	if err != nil {
+		return 0, err
+	}
+	var loc *rawLocation
+	for i, e := range entries {
+		if !e.Raw().IsDotPointer() && string(e.Raw().Name()) == string(raw.Name()) {
+			loc = &locs[i]
+			break
+		}
+	}
+	if loc == nil {
+		return 0, os.ErrNotExist
+	}
+	if raw.IsDir() {
+		return 0, errors.New("cannot append to a directory")
+	}
+
+	file := NewFile(NewChain(f, raw.FirstCluster()), int64(raw.FileSize()))
+	buf := make([]byte, f.ClusterSize())
+	for {
+		m, readErr := r.Read(buf)
+		if m > 0 {
+			written, writeErr := file.WriteAt(buf[:m], file.Size)
+			n += int64(written)
+			if writeErr != nil {
+				err = writeErr
+				break
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+
+	now := f.now()
+	raw.SetFirstCluster(file.Chain.FirstCluster())
+	raw.SetFileSize(uint32(file.Size))
+	raw.SetWrtDate(fatDate(now))
+	raw.SetWrtTime(fatTime(now))
+	raw.SetAttr(raw.Attr() | Archive)
+	updateErr := updateEntryAt(entryChain, *loc, func(r *RawDirEntry) {
+		*r = *raw
+	})
+	if err == nil {
+		err = updateErr
+	}
+	return n, err
+}
+
+// Section creates a reader for n bytes of the file,
+// starting at the byte offset off.
+//
+// The section is limited to the logical size of the file.
+func (f *File) Section(off, n int64) *io.SectionReader {
+	if off < f.Size && off+n > f.Size {
+		n = f.Size - off
+	}
+	return io.NewSectionReader(f, off, n)
+}
+
+// MappableRange finds the sectors which store the file's
+// data, for callers that want to access the device
+// directly.
+//
+// If the clusters holding the file's data are consecutive,
+// contiguous is true and the data is the first byteLen
+// bytes starting at startSector.
+// Otherwise, contiguous is false and the other results
+// are zero.
+// An empty file is contiguous with byteLen 0.
+func (f *File) MappableRange() (startSector uint32, byteLen int64, contiguous bool, err error) {
+	defer essentials.AddCtxTo("MappableRange", &err)
+	if f.Size == 0 {
+		return 0, 0, true, nil
+	}
+	fs := f.Chain.FS()
+	first := NewChain(fs, f.Chain.FirstCluster())
+	startSector, err = first.clusterSector()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	clusterSize := int64(fs.ClusterSize())
+	cluster := first.cluster
+	r := newFATReader(fs)
+	for i := clusterSize; i < f.Size; i += clusterSize {
+		next, err := r.Read(cluster)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if next >= EOF {
+			return 0, 0, false, errors.New("chain is shorter than file")
+		} else if next != cluster+1 {
+			return 0, 0, false, nil
+		}
+		cluster = next
+	}
+	if cluster >= fs.NumClusters() {
+		return 0, 0, false, ErrInvalidCluster
+	}
+	return startSector, f.Size, true, nil
+}
+
+// DetectContentType guesses the MIME type of the file at
+// a path using http.DetectContentType, which considers at
+// most the first 512 bytes of the file.
+func (f *FS) DetectContentType(path string) (string, error) {
+	file, err := f.OpenFile(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 512)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", essentials.AddCtx("DetectContentType", err)
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// ReadFile reads the entire contents of the file at a
+// path.
+func (f *FS) ReadFile(path string) ([]byte, error) {
+	file, err := f.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, file.Size)
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, essentials.AddCtx("ReadFile", err)
+	}
+	return data, nil
+}
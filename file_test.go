@@ -0,0 +1,628 @@
+package fatfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileReadAt(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, fs.ClusterSize()*7/2)
+
+	for _, span := range [][2]int{{0, 10}, {100, 5000}, {4095, 2}, {0, len(contents)},
+		{len(contents) - 3, 3}, {8192, 4096}} {
+		buf := make([]byte, span[1])
+		n, err := file.ReadAt(buf, int64(span[0]))
+		if err != nil {
+			t.Errorf("span %v: %v", span, err)
+		} else if n != span[1] {
+			t.Errorf("span %v: read %d bytes", span, n)
+		}
+		if !bytes.Equal(buf, contents[span[0]:span[0]+span[1]]) {
+			t.Errorf("span %v: data mismatch", span)
+		}
+	}
+
+	buf := make([]byte, 100)
+	if n, err := file.ReadAt(buf, int64(len(contents)-10)); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	} else if n != 10 || !bytes.Equal(buf[:n], contents[len(contents)-10:]) {
+		t.Errorf("unexpected partial read of %d bytes", n)
+	}
+	if _, err := file.ReadAt(buf, int64(len(contents))); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+}
+
+func TestFileReadCache(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	file, contents := createTestFile(t, fs, clusterSize*7/2)
+
+	for i := 0; i < 1000; i++ {
+		off := rand.Intn(len(contents))
+		buf := make([]byte, rand.Intn(clusterSize/2)+1)
+		n, err := file.ReadAt(buf, int64(off))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], contents[off:off+n]) {
+			t.Fatalf("data mismatch at offset %d", off)
+		}
+		if n < len(buf) && off+n != len(contents) {
+			t.Fatalf("short read at offset %d", off)
+		}
+	}
+
+	var reads int
+	fs.OnSectorRead = func(sector uint32) {
+		reads++
+	}
+	buf := make([]byte, 16)
+	for off := clusterSize; off+len(buf) <= clusterSize*2; off += len(buf) {
+		if _, err := file.ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads > clusterSize/SectorSize+1 {
+		t.Errorf("too many sector reads: %d", reads)
+	}
+
+	if _, err := file.WriteAt([]byte("hello"), int64(clusterSize+100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.ReadAt(buf[:5], int64(clusterSize+100)); err != nil {
+		t.Fatal(err)
+	} else if string(buf[:5]) != "hello" {
+		t.Errorf("stale data after write: %q", buf[:5])
+	}
+	if err := file.Truncate(int64(clusterSize+102), true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := file.ReadAt(buf[:5], int64(clusterSize+100)); err != io.EOF || n != 2 {
+		t.Errorf("expected 2 bytes and EOF but got %d and %v", n, err)
+	}
+}
+
+func TestFileReadAtConcurrent(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, fs.ClusterSize()*7/2)
+	if _, err := file.Chain.Seek(2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	cluster := file.Chain.cluster
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func(seed int64) {
+			gen := rand.New(rand.NewSource(seed))
+			for j := 0; j < 200; j++ {
+				off := gen.Intn(len(contents))
+				buf := make([]byte, gen.Intn(len(contents)-off)+1)
+				if _, err := file.ReadAt(buf, int64(off)); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, contents[off:off+len(buf)]) {
+					errs <- fmt.Errorf("data mismatch at offset %d", off)
+					return
+				}
+			}
+			errs <- nil
+		}(int64(i))
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if file.Chain.cluster != cluster {
+		t.Error("ReadAt moved the chain")
+	}
+}
+
+func TestFileSection(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, 10000)
+
+	data, err := ioutil.ReadAll(file.Section(3000, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, contents[3000:8000]) {
+		t.Error("section data mismatch")
+	}
+
+	section := file.Section(9000, 5000)
+	if section.Size() != 1000 {
+		t.Errorf("expected section size 1000 but got %d", section.Size())
+	}
+	data, err = ioutil.ReadAll(section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, contents[9000:]) {
+		t.Error("section data mismatch")
+	}
+}
+
+func createTestFile(t *testing.T, fs *FS, size int) (*File, []byte) {
+	contents := make([]byte, size)
+	rand.Read(contents)
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, cluster)
+	if _, err := chain.ReadFrom(bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	return NewFile(chain, int64(size)), contents
+}
+
+func TestDetectContentType(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	files := map[string][]byte{
+		"small.txt": []byte("hello"),
+		"page.htm":  []byte("<html><body>" + strings.Repeat("x", 10000) + "</body></html>"),
+		"empty.bin": nil,
+	}
+	for name, data := range files {
+		if _, err := CreateFile(root, name, bytes.NewReader(data), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		"small.txt": "text/plain; charset=utf-8",
+		"page.htm":  "text/html; charset=utf-8",
+		"empty.bin": "text/plain; charset=utf-8",
+	} {
+		actual, err := fs.DetectContentType(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %q but got %q", name, expected, actual)
+		}
+	}
+	if _, err := fs.DetectContentType("missing"); err != os.ErrNotExist {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOpenChain(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, 10000)
+	opened, err := fs.OpenChain(file.Chain.FirstCluster(), int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadAll(opened.Section(0, opened.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, contents) {
+		t.Error("unexpected contents")
+	}
+
+	empty, err := fs.OpenChain(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.ReadAt(make([]byte, 1), 0); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+
+	for _, args := range [][2]int64{{0, 1}, {1, 10}, {int64(fs.NumClusters()), 10}, {3, -1}} {
+		if _, err := fs.OpenChain(uint32(args[0]), args[1]); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestFileSeekReadWrite(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, 10000)
+
+	if offset, err := file.Seek(5000, io.SeekStart); err != nil || offset != 5000 {
+		t.Fatalf("unexpected seek result: %d, %v", offset, err)
+	}
+	if offset, err := file.Seek(-10, io.SeekCurrent); err != nil || offset != 4990 {
+		t.Fatalf("unexpected seek result: %d, %v", offset, err)
+	}
+	buf := make([]byte, 20)
+	if n, err := file.Read(buf); err != nil || n != 20 {
+		t.Fatalf("unexpected read result: %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, contents[4990:5010]) {
+		t.Error("unexpected data")
+	}
+	if offset, _ := file.Seek(-5, io.SeekEnd); offset != 9995 {
+		t.Errorf("expected offset 9995 but got %d", offset)
+	}
+	if n, err := file.Read(buf); err != nil || n != 5 {
+		t.Fatalf("unexpected read result: %d, %v", n, err)
+	}
+	if _, err := file.Read(buf); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if _, err := file.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected error for negative offset")
+	}
+
+	// Overwrite across a cluster boundary.
+	patch := make([]byte, 200)
+	rand.Read(patch)
+	if _, err := file.Seek(4000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := file.Write(patch); err != nil || n != len(patch) {
+		t.Fatalf("unexpected write result: %d, %v", n, err)
+	}
+	copy(contents[4000:], patch)
+
+	// Write past the end, leaving a gap.
+	if _, err := file.Seek(20000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Read(buf); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if _, err := file.Write(patch); err != nil {
+		t.Fatal(err)
+	}
+	contents = append(contents, make([]byte, 10000)...)
+	contents = append(contents, patch...)
+	if file.Size != int64(len(contents)) {
+		t.Errorf("expected size %d but got %d", len(contents), file.Size)
+	}
+
+	actual, err := ioutil.ReadAll(file.Section(0, file.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, contents) {
+		t.Error("unexpected contents after writes")
+	}
+
+	empty, err := fs.OpenChain(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.WriteAt(patch, 10); err != nil {
+		t.Fatal(err)
+	}
+	if empty.Chain.FirstCluster() == 0 || empty.Size != 210 {
+		t.Errorf("empty file was not extended (cluster %d, size %d)",
+			empty.Chain.FirstCluster(), empty.Size)
+	}
+	actual, err = ioutil.ReadAll(empty.Section(0, empty.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, append(make([]byte, 10), patch...)) {
+		t.Error("unexpected contents of extended empty file")
+	}
+}
+
+func TestFileTruncate(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zeroSlack := range []bool{false, true} {
+		file, contents := createTestFile(t, fs, 20000)
+		clusters, err := file.Chain.AppendClusters(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Truncate(5000, zeroSlack); err != nil {
+			t.Fatal(err)
+		}
+		if file.Size != 5000 {
+			t.Errorf("expected size 5000 but got %d", file.Size)
+		}
+		var raw bytes.Buffer
+		if _, err := file.Chain.WriteTo(&raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw.Len() != 2*fs.ClusterSize() {
+			t.Errorf("expected 2 clusters but got %d bytes", raw.Len())
+		}
+		if !bytes.Equal(raw.Bytes()[:5000], contents[:5000]) {
+			t.Error("retained data was modified")
+		}
+		slack := raw.Bytes()[5000:]
+		if zeroSlack && !bytes.Equal(slack, make([]byte, len(slack))) {
+			t.Error("slack was not zeroed")
+		} else if !zeroSlack && !bytes.Equal(slack, contents[5000:raw.Len()]) {
+			t.Error("slack was modified")
+		}
+		for _, cluster := range clusters[2:] {
+			if contents, err := fs.ReadFAT(cluster); err != nil {
+				t.Fatal(err)
+			} else if contents != 0 {
+				t.Errorf("cluster %d was not freed", cluster)
+			}
+		}
+
+		if err := file.Truncate(9000, zeroSlack); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadAll(file.Section(0, file.Size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append(append([]byte{}, contents[:5000]...), make([]byte, 4000)...)
+		if !bytes.Equal(actual, expected) {
+			t.Error("unexpected contents after growing")
+		}
+
+		if err := file.Truncate(0, zeroSlack); err != nil {
+			t.Fatal(err)
+		}
+		if file.Size != 0 || file.Chain.FirstCluster() != 0 {
+			t.Error("file was not emptied")
+		}
+	}
+}
+
+func TestFileWriteToMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("copies a multi-gigabyte file")
+	}
+	const numSectors = 6 << 20
+	bs, err := NewBootSector32(numSectors, "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &syntheticDevice{
+		meta:       make(RAMDisk, (int(bs.RsvdSecCnt())+2*int(bs.FatSz32()))*SectorSize),
+		numSectors: numSectors,
+	}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a contiguous chain by editing the FAT directly.
+	const fileSize = 5 << 29
+	numClusters := uint32(fileSize / fs.ClusterSize())
+	fatStart := int(fs.BootSector.RsvdSecCnt()) * SectorSize
+	for i := uint32(0); i < numClusters; i++ {
+		next := i + 4
+		if i+1 == numClusters {
+			next = EOF
+		}
+		Endian.PutUint32(dev.meta[fatStart+int(i+3)*4:], next)
+	}
+	file := NewFile(NewChain(fs, 3), fileSize)
+
+	defer debug.SetGCPercent(debug.SetGCPercent(20))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	w := &heapSampler{baseline: stats.HeapAlloc}
+	if n, err := io.Copy(w, file); err != nil {
+		t.Fatal(err)
+	} else if n != fileSize {
+		t.Fatalf("expected %d bytes but got %d", fileSize, n)
+	}
+	if w.peak > 16<<20 {
+		t.Errorf("heap grew by %d bytes during copy", w.peak)
+	}
+}
+
+// A syntheticDevice keeps the reserved sectors and FATs in
+// memory, but generates the contents of the data region,
+// so that it can hold a very large volume.
+type syntheticDevice struct {
+	meta       RAMDisk
+	numSectors uint32
+}
+
+func (s *syntheticDevice) NumSectors() uint32 {
+	return s.numSectors
+}
+
+func (s *syntheticDevice) ReadSector(idx uint32) (*Sector, error) {
+	if idx < s.meta.NumSectors() {
+		return s.meta.ReadSector(idx)
+	}
+	var sec Sector
+	for i := range sec {
+		sec[i] = byte(idx)
+	}
+	return &sec, nil
+}
+
+func (s *syntheticDevice) WriteSector(idx uint32, value *Sector) error {
+	if idx < s.meta.NumSectors() {
+		return s.meta.WriteSector(idx, value)
+	}
+	return nil
+}
+
+// A heapSampler is an io.Writer that tracks how far the
+// heap grows beyond a baseline while it is written to.
+type heapSampler struct {
+	baseline uint64
+	peak     uint64
+	writes   int
+}
+
+func (h *heapSampler) Write(p []byte) (int, error) {
+	h.writes++
+	if h.writes%4096 == 0 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > h.baseline && stats.HeapAlloc-h.baseline > h.peak {
+			h.peak = stats.HeapAlloc - h.baseline
+		}
+	}
+	return len(p), nil
+}
+
+func TestAppend(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	contents := make([]byte, 5000)
+	rand.Read(contents)
+	if _, err := CreateFile(root, "log.txt", bytes.NewReader(contents), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(root, "empty.txt", bytes.NewReader(nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]byte{"log.txt": contents, "empty.txt": nil}
+	for i := 0; i < 3; i++ {
+		for name := range expected {
+			entry, err := root.Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := bytes.Repeat([]byte(fmt.Sprintf("line %d\n", i)), 700)
+			if n, err := fs.Append(&entry, root.Chain, bytes.NewReader(line)); err != nil {
+				t.Fatal(err)
+			} else if n != int64(len(line)) {
+				t.Errorf("expected %d bytes but got %d", len(line), n)
+			}
+			expected[name] = append(expected[name], line...)
+			if entry.Raw().FileSize() != uint32(len(expected[name])) {
+				t.Errorf("%s: entry was not updated", name)
+			}
+		}
+	}
+
+	for name, data := range expected {
+		file, err := fs.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, data) {
+			t.Errorf("%s: unexpected contents", name)
+		}
+	}
+}
+
+func TestMappableRange(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contents := createTestFile(t, fs, 10000)
+	start, length, contiguous, err := file.MappableRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contiguous || length != int64(len(contents)) {
+		t.Fatalf("unexpected result: %d, %d, %v", start, length, contiguous)
+	}
+	if !bytes.Equal(dev[start*SectorSize:int64(start)*SectorSize+length], contents) {
+		t.Error("unexpected contents at mapped range")
+	}
+
+	for _, link := range [][2]uint32{{500, 600}, {600, EOF}} {
+		if err := fs.WriteFAT(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fragmented, err := fs.OpenChain(500, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, contiguous, err := fragmented.MappableRange(); err != nil {
+		t.Fatal(err)
+	} else if contiguous {
+		t.Error("fragmented file should not be contiguous")
+	}
+
+	short, err := fs.OpenChain(600, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := short.MappableRange(); err == nil {
+		t.Error("expected error for short chain")
+	}
+}
+
+func TestFileReadFrom(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.OpenChain(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := []byte("0123456789")
+	if _, err := file.Write(head); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5000)
+	rand.Read(data)
+	n, err := io.Copy(file, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || file.Size != int64(len(head)+len(data)) {
+		t.Fatalf("unexpected counts: n=%d size=%d", n, file.Size)
+	}
+	actual, err := ioutil.ReadAll(file.Section(0, file.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, append(head, data...)) {
+		t.Error("unexpected contents")
+	}
+}
@@ -2,17 +2,62 @@ package fatfs
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/unixpickle/essentials"
 )
 
+// ErrNoSpace is returned when there are no free clusters
+// left to allocate.
+var ErrNoSpace = errors.New("no free clusters")
+
+// ErrClosed is returned when a closed FS is used.
+var ErrClosed = errors.New("file-system is closed")
+
+// cleanShutdownBit is set in FAT entry 1 when the volume
+// was unmounted cleanly.
+const cleanShutdownBit = 0x08000000
+
 // FS provides all the information needed to perform
 // file-system operations.
 type FS struct {
 	Device     BlockDevice
 	BootSector *BootSector
 
+	// OnSectorRead and OnSectorWrite, if non-nil, are
+	// called with the index of every sector that the FS
+	// reads from or writes to the device.
+	OnSectorRead  func(sector uint32)
+	OnSectorWrite func(sector uint32)
+
 	fatSectors []uint32
+
+	// allocCursor is the cluster where Alloc starts
+	// searching for a free cluster.
+	allocCursor uint32
+
+	// refCounts, if non-nil, counts the FAT entries which
+	// point to each cluster.
+	refCounts []uint8
+
+	clock func() time.Time
+
+	// fatCache, if non-nil, holds the first FAT.
+	// Its sectors are never modified in place, so that it
+	// can be shared with dry runs and transactions.
+	fatCache []*Sector
+
+	// fatCacheShared is set if fatCache may be shared, in
+	// which case it is copied before a sector is replaced.
+	fatCacheShared bool
+
+	// dirty is set by the first write, which clears the
+	// clean shutdown bit until Close sets it again.
+	dirty bool
+
+	closed bool
 }
 
 // NewFS creates a file-system using the block device.
@@ -22,12 +67,120 @@ func NewFS(b BlockDevice) (*FS, error) {
 		return nil, essentials.AddCtx("NewFS", err)
 	}
 	bs := BootSector(*bsData)
+	if bs.BytesPerSec() != SectorSize {
+		return nil, essentials.AddCtx("NewFS", fmt.Errorf("unsupported sector size: %d",
+			bs.BytesPerSec()))
+	}
+	if bs.SecPerClus() == 0 {
+		return nil, essentials.AddCtx("NewFS", errors.New("invalid sectors per cluster"))
+	}
+	if bs.TotSec() > b.NumSectors() {
+		return nil, essentials.AddCtx("NewFS", fmt.Errorf("volume has %d sectors but device has %d",
+			bs.TotSec(), b.NumSectors()))
+	}
+	if bs.RsvdSecCnt() == 0 {
+		return nil, essentials.AddCtx("NewFS", errors.New("invalid reserved sector count"))
+	}
+	if bs.NumFATs() == 0 {
+		return nil, essentials.AddCtx("NewFS", errors.New("volume has no FAT"))
+	}
+	fatEnd := uint64(bs.RsvdSecCnt()) + uint64(bs.NumFATs())*uint64(bs.FatSz32())
+	if fatEnd >= uint64(bs.TotSec()) {
+		return nil, essentials.AddCtx("NewFS", errors.New("no room for data region"))
+	}
 	fs := &FS{Device: b, BootSector: &bs}
 	offset := uint32(bs.RsvdSecCnt())
 	for i := 0; i < int(bs.NumFATs()); i++ {
 		fs.fatSectors = append(fs.fatSectors, offset)
 		offset += bs.FatSz32()
 	}
+	if uint64(fs.NumClusters())*4 > uint64(bs.FatSz32())*SectorSize {
+		return nil, essentials.AddCtx("NewFS", errors.New("FAT is too small for all clusters"))
+	}
+	fs.allocCursor = fs.nextFreeHint()
+	return fs, nil
+}
+
+// A FATType identifies a variant of the FAT file-system.
+type FATType int
+
+const (
+	FAT12 FATType = 12
+	FAT16 FATType = 16
+	FAT32 FATType = 32
+)
+
+// String returns a name like "FAT32".
+func (t FATType) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// FATType determines the type of the volume from its
+// number of data clusters, as in the FAT specification:
+// fewer than 4085 clusters is FAT12, fewer than 65525 is
+// FAT16, and anything more is FAT32.
+//
+// The count is computed from the boot sector using the
+// 16-bit FAT size where it is set, so that it is correct
+// even for volumes this package cannot otherwise use.
+func (f *FS) FATType() FATType {
+	b := f.BootSector
+	rootDirSectors := (uint64(b.RootEntCnt())*32 + SectorSize - 1) / SectorSize
+	fatSize := uint64(b.FatSz16())
+	if fatSize == 0 {
+		fatSize = uint64(b.FatSz32())
+	}
+	totalSectors := uint64(b.TotSec())
+	overhead := uint64(b.RsvdSecCnt()) + uint64(b.NumFATs())*fatSize + rootDirSectors
+	var clusters uint64
+	if totalSectors > overhead && b.SecPerClus() != 0 {
+		clusters = (totalSectors - overhead) / uint64(b.SecPerClus())
+	}
+	if clusters < 4085 {
+		return FAT12
+	} else if clusters < 65525 {
+		return FAT16
+	}
+	return FAT32
+}
+
+// IsFAT32 checks if FATType is FAT32.
+//
+// The rest of this package assumes a FAT32 volume, so
+// this can be used to fail early on other volumes.
+func (f *FS) IsFAT32() bool {
+	return f.FATType() == FAT32
+}
+
+// NewFSWithType is like NewFS, but the FAT type is given
+// by the caller rather than inferred from the volume.
+// This can be used to mount volumes whose boot sectors
+// are partially damaged.
+//
+// Only FAT32 is supported, so other types are rejected.
+// The boot sector must still be plausible for the type:
+// for FAT32, the FAT size must be stored in FatSz32, there
+// must be no fixed-size root directory, and the root
+// cluster must be in range.
+func NewFSWithType(b BlockDevice, t FATType) (fs *FS, err error) {
+	defer essentials.AddCtxTo("NewFSWithType", &err)
+	if t != FAT32 {
+		return nil, fmt.Errorf("unsupported FAT type: %s", t)
+	}
+	fs, err = NewFS(b)
+	if err != nil {
+		return nil, err
+	}
+	bs := fs.BootSector
+	if bs.FatSz32() == 0 {
+		return nil, errors.New("FAT32 volume must have non-zero FatSz32")
+	}
+	if bs.RootEntCnt() != 0 {
+		return nil, errors.New("FAT32 volume cannot have a fixed root directory")
+	}
+	if bs.RootClus() < 2 || bs.RootClus() >= fs.NumClusters() {
+		return nil, ErrInvalidCluster
+	}
 	return fs, nil
 }
 
@@ -38,14 +191,101 @@ func NewFS(b BlockDevice) (*FS, error) {
 // on the device was already zeroes.
 func FormatFS(b BlockDevice, label string, erase bool) (fs *FS, err error) {
 	defer essentials.AddCtxTo("FormatFS", &err)
-	bs, err := NewBootSector32(b.NumSectors(), label)
+	return formatFS(b, &FormatOptions{Label: label, Erase: erase})
+}
+
+// FormatOptions controls how FormatFSWithOptions formats
+// a device.
+type FormatOptions struct {
+	// Label is the volume label.
+	Label string
+
+	// Erase indicates that the reserved sectors and FATs
+	// should be zeroed, as in FormatFS.
+	Erase bool
+
+	// BootCode, if non-nil, is written to the boot code
+	// area of the boot sector, which lies between the
+	// extended BPB and the boot signature.
+	// It can be at most BootCodeSize bytes.
+	//
+	// When boot code is given, the jump instruction at the
+	// start of the boot sector jumps to it.
+	BootCode []byte
+
+	// NumFATs is the number of copies of the FAT, which
+	// must be 1 or 2.
+	// If it is 0, two FATs are used.
+	NumFATs int
+
+	// PreserveBootCode keeps the boot code (and the jump
+	// instruction) already on the device, if BootCode is
+	// nil.
+	PreserveBootCode bool
+
+	// ReservedSectors is the number of sectors before the
+	// first FAT, including the boot sector and the FSInfo
+	// sector, so it must be at least 2.
+	// If it is 0, the default of 2 is used.
+	ReservedSectors int
+}
+
+// The location of the boot code area in a FAT32 boot
+// sector.
+const (
+	BootCodeOffset = 90
+	BootCodeSize   = 510 - BootCodeOffset
+)
+
+// FormatFSWithOptions is like FormatFS, but with more
+// control over the resulting file-system.
+// If opts is nil, the zero FormatOptions are used.
+func FormatFSWithOptions(b BlockDevice, opts *FormatOptions) (fs *FS, err error) {
+	defer essentials.AddCtxTo("FormatFSWithOptions", &err)
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+	return formatFS(b, opts)
+}
+
+func formatFS(b BlockDevice, opts *FormatOptions) (fs *FS, err error) {
+	bs, err := NewBootSector32(b.NumSectors(), opts.Label)
 	if err != nil {
 		return nil, err
 	}
+	if opts.NumFATs != 0 {
+		if opts.NumFATs != 1 && opts.NumFATs != 2 {
+			return nil, fmt.Errorf("unsupported number of FATs: %d", opts.NumFATs)
+		}
+		bs.SetNumFATs(uint8(opts.NumFATs))
+	}
+	if opts.ReservedSectors != 0 {
+		if opts.ReservedSectors < 2 || opts.ReservedSectors > 0xffff {
+			return nil, fmt.Errorf("unsupported number of reserved sectors: %d",
+				opts.ReservedSectors)
+		}
+		bs.SetRsvdSecCnt(uint16(opts.ReservedSectors))
+	}
+	if opts.BootCode != nil {
+		if len(opts.BootCode) > BootCodeSize {
+			return nil, fmt.Errorf("boot code is %d bytes (maximum %d)", len(opts.BootCode),
+				BootCodeSize)
+		}
+		copy(bs.BootJump(), []byte{0xeb, BootCodeOffset - 2, 0x90})
+		copy(bs[BootCodeOffset:510], opts.BootCode)
+	} else if opts.PreserveBootCode {
+		old, err := b.ReadSector(0)
+		if err != nil {
+			return nil, err
+		}
+		copy(bs.BootJump(), old[:3])
+		copy(bs[BootCodeOffset:510], old[BootCodeOffset:510])
+	}
 
 	var sec Sector
-	if erase {
-		for i := 0; i < int(bs.RsvdSecCnt())+2*int(bs.FatSz32()); i++ {
+	if opts.Erase {
+		numSectors := int(bs.RsvdSecCnt()) + int(bs.NumFATs())*int(bs.FatSz32())
+		for i := 0; i < numSectors; i++ {
 			if err := b.WriteSector(uint32(i), &sec); err != nil {
 				return nil, err
 			}
@@ -76,68 +316,897 @@ func FormatFS(b BlockDevice, label string, erase bool) (fs *FS, err error) {
 	return fs, nil
 }
 
+// ValidateFormat re-reads the structures written by
+// FormatFS from the device to check that they were stored
+// correctly.
+// This catches devices which drop writes or write to the
+// wrong sectors.
+//
+// It checks that the boot sector matches BootSector and
+// has its signature, that the FSInfo sector is valid, and
+// that in every copy of the FAT, entry 0 holds the media
+// byte, entry 1 holds an end-of-chain marker, and the root
+// directory's cluster is allocated.
+func (f *FS) ValidateFormat() (err error) {
+	defer essentials.AddCtxTo("ValidateFormat", &err)
+	bs, err := f.readSector(0)
+	if err != nil {
+		return err
+	}
+	if BootSector(*bs) != *f.BootSector {
+		return errors.New("boot sector does not match")
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return errors.New("boot sector is missing its signature")
+	}
+	if info, err := f.ReadFSInfo(); err != nil {
+		return err
+	} else if !info.Valid() {
+		return errors.New("FSInfo sector has invalid signatures")
+	}
+
+	rootCluster := f.BootSector.RootClus()
+	if rootCluster < 2 || rootCluster >= f.NumClusters() {
+		return ErrInvalidCluster
+	}
+	rootSector, rootIdx := fatIndices(rootCluster)
+	for i, offset := range f.fatSectors {
+		block, err := f.readSector(offset)
+		if err != nil {
+			return err
+		}
+		if entry := fatEntry(block, 0); entry != 0x0fffff00|uint32(f.BootSector.Media()) {
+			return fmt.Errorf("FAT %d: entry 0 is 0x%x, which does not match the media byte",
+				i, entry)
+		}
+		// The clean shutdown and hard error flags may be
+		// cleared from entry 1.
+		if entry := fatEntry(block, 4); entry|0x0c000000 < EOF {
+			return fmt.Errorf("FAT %d: entry 1 is 0x%x, which is not an end-of-chain marker",
+				i, entry)
+		}
+		if rootSector != 0 {
+			block, err = f.readSector(offset + rootSector)
+			if err != nil {
+				return err
+			}
+		}
+		if entry := fatEntry(block, rootIdx); entry == 0 || entry == badCluster {
+			return fmt.Errorf("FAT %d: root directory cluster %d is not allocated", i,
+				rootCluster)
+		}
+	}
+	return nil
+}
+
+// RootDir gets a Chain for the root directory, which
+// starts at the cluster given by BootSector.RootClus().
+//
+// This is equivalent to RootDirChain(f).
+func (f *FS) RootDir() *Chain {
+	return RootDirChain(f)
+}
+
+// SetVolumeLabel changes the volume label stored in the
+// boot sector.
+//
+// The label must meet the requirements described in
+// NewBootSector32.
+func (f *FS) SetVolumeLabel(label string) (err error) {
+	defer essentials.AddCtxTo("SetVolumeLabel", &err)
+	formatted, err := formatVolumeLabel(label)
+	if err != nil {
+		return err
+	}
+	bs := *f.BootSector
+	copy(bs.VolLab(), []byte(formatted))
+	sec := Sector(bs)
+	if err := f.writeSector(0, &sec); err != nil {
+		return err
+	}
+	*f.BootSector = bs
+	return nil
+}
+
+// SetClock sets the function used to get the current time
+// when a timestamp is needed but not given, such as when
+// Mkdir or CreateFile is passed the zero time.
+//
+// This can be used to build reproducible images.
+// If clock is nil, time.Now is used, which is the default.
+func (f *FS) SetClock(clock func() time.Time) {
+	f.clock = clock
+}
+
+func (f *FS) now() time.Time {
+	if f.clock != nil {
+		return f.clock()
+	}
+	return time.Now()
+}
+
 // ClusterSize gets the number of bytes per cluster.
 func (f *FS) ClusterSize() int {
 	return int(f.BootSector.SecPerClus()) * SectorSize
 }
 
-// NumClusters gets the number of data clusters.
+// NumClusters gets the number of FAT entries in use,
+// including the two reserved entries at the start of the
+// FAT.
+//
+// Since data clusters are numbered starting at 2, this is
+// one more than MaxClusterIndex, and two more than
+// DataClusterCount.
 func (f *FS) NumClusters() uint32 {
+	_, numSectors := f.DataRegion()
+	return 2 + numSectors/uint32(f.BootSector.SecPerClus())
+}
+
+// FATSizeBytes gets the size of one copy of the FAT, as
+// recorded in the boot sector.
+func (f *FS) FATSizeBytes() int64 {
+	return int64(f.BootSector.FatSz32()) * SectorSize
+}
+
+// RequiredFATSizeBytes gets the smallest FAT size, rounded
+// up to a whole sector, that can hold an entry for every
+// cluster, including the two reserved entries.
+//
+// Any difference from FATSizeBytes is unused space.
+func (f *FS) RequiredFATSizeBytes() int64 {
+	size := int64(f.NumClusters()) * 4
+	return (size + SectorSize - 1) / SectorSize * SectorSize
+}
+
+// MaxClusterIndex gets the highest valid data cluster
+// number.
+func (f *FS) MaxClusterIndex() uint32 {
+	return f.NumClusters() - 1
+}
+
+// DataClusterCount gets the number of data clusters,
+// which are numbered 2 through MaxClusterIndex.
+func (f *FS) DataClusterCount() uint32 {
+	return f.NumClusters() - 2
+}
+
+// CountFreeClusters counts the data clusters which are
+// marked as free in the FAT.
+func (f *FS) CountFreeClusters() (count uint32, err error) {
+	r := newFATReader(f)
+	for cluster := uint32(2); cluster <= f.MaxClusterIndex(); cluster++ {
+		contents, err := r.Read(cluster)
+		if err != nil {
+			return 0, essentials.AddCtx("CountFreeClusters", err)
+		}
+		if contents == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// A ClusterRange is a run of consecutive clusters.
+type ClusterRange struct {
+	Start  uint32
+	Length uint32
+}
+
+// FreeRanges finds the maximal runs of consecutive free
+// clusters, in order of their starting cluster.
+func (f *FS) FreeRanges() (ranges []ClusterRange, err error) {
+	r := newFATReader(f)
+	for cluster := uint32(2); cluster <= f.MaxClusterIndex(); cluster++ {
+		contents, err := r.Read(cluster)
+		if err != nil {
+			return nil, essentials.AddCtx("FreeRanges", err)
+		}
+		if contents != 0 {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Start+ranges[n-1].Length == cluster {
+			ranges[n-1].Length++
+		} else {
+			ranges = append(ranges, ClusterRange{Start: cluster, Length: 1})
+		}
+	}
+	return ranges, nil
+}
+
+// LargestFreeRun finds the longest run of consecutive
+// free clusters.
+// If there are several, the first one is returned.
+// If there are no free clusters, length is 0.
+func (f *FS) LargestFreeRun() (start, length uint32, err error) {
+	ranges, err := f.FreeRanges()
+	if err != nil {
+		return 0, 0, essentials.AddCtx("LargestFreeRun", err)
+	}
+	for _, r := range ranges {
+		if r.Length > length {
+			start, length = r.Start, r.Length
+		}
+	}
+	return start, length, nil
+}
+
+// AllocatedChains reconstructs every cluster chain in the
+// FAT, without using the directory structure.
+//
+// A chain starts at each allocated cluster which no other
+// cluster points to.
+// Clusters marked as bad are not part of any chain.
+// Each cluster appears in at most one chain: when chains
+// are cross-linked, the shared clusters belong to the
+// first chain that reaches them, and the other chain ends
+// before the shared part.
+// Cycles which no chain leads into are returned as chains
+// starting at their lowest cluster.
+func (f *FS) AllocatedChains() (chains [][]uint32, err error) {
+	max := f.MaxClusterIndex()
+	entries := make([]uint32, max+1)
+	referenced := make([]bool, max+1)
+	r := newFATReader(f)
+	for cluster := uint32(2); cluster <= max; cluster++ {
+		contents, err := r.Read(cluster)
+		if err != nil {
+			return nil, essentials.AddCtx("AllocatedChains", err)
+		}
+		entries[cluster] = contents
+	}
+	for cluster := uint32(2); cluster <= max; cluster++ {
+		if next := entries[cluster]; next >= 2 && next <= max {
+			referenced[next] = true
+		}
+	}
+
+	visited := make([]bool, max+1)
+	walk := func(start uint32) []uint32 {
+		var chain []uint32
+		for cluster := start; cluster >= 2 && cluster <= max && !visited[cluster]; {
+			contents := entries[cluster]
+			if contents == 0 || contents == badCluster {
+				break
+			}
+			visited[cluster] = true
+			chain = append(chain, cluster)
+			cluster = contents
+		}
+		return chain
+	}
+	isAllocated := func(cluster uint32) bool {
+		return entries[cluster] != 0 && entries[cluster] != badCluster
+	}
+	for cluster := uint32(2); cluster <= max; cluster++ {
+		if isAllocated(cluster) && !referenced[cluster] {
+			chains = append(chains, walk(cluster))
+		}
+	}
+	for cluster := uint32(2); cluster <= max; cluster++ {
+		if isAllocated(cluster) && !visited[cluster] {
+			chains = append(chains, walk(cluster))
+		}
+	}
+	return chains, nil
+}
+
+// Geometry describes the physical layout of a volume.
+type Geometry struct {
+	// BytesPerSector is always SectorSize, since NewFS
+	// rejects volumes with other sector sizes.
+	BytesPerSector int
+
+	SectorsPerCluster int
+	ClusterSize       int
+
+	// ReservedSectors is the number of sectors before the
+	// first FAT.
+	ReservedSectors int
+
+	NumFATs int
+
+	// FATSectors is the size of each FAT in sectors.
+	FATSectors uint32
+
+	// FirstDataSector is the sector where cluster 2 starts.
+	FirstDataSector uint32
+
+	// DataSectors is the size of the data region, which
+	// may end with a partial cluster.
+	DataSectors uint32
+
+	// NumClusters is the same as FS.NumClusters.
+	NumClusters uint32
+}
+
+// Geometry gets the layout of the volume.
+func (f *FS) Geometry() Geometry {
+	b := f.BootSector
+	firstData, dataSectors := f.DataRegion()
+	return Geometry{
+		BytesPerSector:    int(b.BytesPerSec()),
+		SectorsPerCluster: int(b.SecPerClus()),
+		ClusterSize:       f.ClusterSize(),
+		ReservedSectors:   int(b.RsvdSecCnt()),
+		NumFATs:           int(b.NumFATs()),
+		FATSectors:        b.FatSz32(),
+		FirstDataSector:   firstData,
+		DataSectors:       dataSectors,
+		NumClusters:       f.NumClusters(),
+	}
+}
+
+// DataRegion gets the location of the data region, which
+// follows the reserved sectors and the FATs.
+//
+// Cluster 2 starts at firstSector.
+// The sector count includes any sectors at the end of the
+// volume which are too few to form a whole cluster.
+func (f *FS) DataRegion() (firstSector, sectorCount uint32) {
 	b := f.BootSector
-	numSectors := b.TotSec32() - (b.FatSz32()*uint32(b.NumFATs()) + uint32(b.RsvdSecCnt()))
-	return 2 + numSectors/uint32(b.SecPerClus())
+	firstSector = uint32(b.RsvdSecCnt()) + uint32(b.NumFATs())*b.FatSz32()
+	return firstSector, b.TotSec() - firstSector
+}
+
+// Sync flushes the device to persistent storage if it
+// implements Syncer. Otherwise, it does nothing.
+func (f *FS) Sync() error {
+	if f.closed {
+		return essentials.AddCtx("Sync", ErrClosed)
+	}
+	if syncer, ok := f.Device.(Syncer); ok {
+		return essentials.AddCtx("Sync", syncer.Sync())
+	}
+	return nil
+}
+
+// Close finalizes the volume, after which f can no longer
+// be used.
+//
+// The free cluster count and the next free cluster hint
+// are stored in the FSInfo sector and its backup (if the
+// volume has them), the clean shutdown bit is set in the
+// FAT, and the device is synced.
+// The clean shutdown bit is cleared again by the first
+// write after the volume is opened.
+// Once Close has been called, any method which accesses
+// the device returns ErrClosed.
+// Closing an FS again does nothing and returns nil.
+func (f *FS) Close() (err error) {
+	defer essentials.AddCtxTo("Close", &err)
+	if f.closed {
+		return nil
+	}
+	if info, err := f.ReadFSInfo(); err == nil && info.LeadSig == FSInfoLeadSig {
+		free, err := f.CountFreeClusters()
+		if err != nil {
+			return err
+		}
+		info.FreeCount = free
+		info.NextFree = FSInfoUnknown
+		if f.allocCursor >= 2 && f.allocCursor < f.NumClusters() {
+			info.NextFree = f.allocCursor
+		}
+		if err := f.WriteFSInfo(info); err != nil {
+			return err
+		}
+		if _, err := f.fsInfoIndex(true); err == nil {
+			if err := f.BackupFSInfo(); err != nil {
+				return err
+			}
+		}
+	}
+	flags, err := f.ReadFAT(1)
+	if err != nil {
+		return err
+	}
+	if err := f.WriteFAT(1, flags|cleanShutdownBit); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	f.fatCache = nil
+	f.closed = true
+	return nil
+}
+
+// MediaType reads the media byte from the low byte of FAT
+// entry 0, which should match the boot sector's Media
+// field.
+func (f *FS) MediaType() (byte, error) {
+	contents, err := f.ReadFAT(0)
+	if err != nil {
+		return 0, essentials.AddCtx("MediaType", err)
+	}
+	return byte(contents), nil
+}
+
+// EndOfChainMarker reads FAT entry 1, which holds an
+// end-of-chain marker.
+//
+// On FAT32, the high bits of this entry are flags: bit 27
+// is set if the volume was unmounted cleanly (see Close),
+// and bit 26 is set if no disk errors were encountered.
+func (f *FS) EndOfChainMarker() (uint32, error) {
+	contents, err := f.ReadFAT(1)
+	if err != nil {
+		return 0, essentials.AddCtx("EndOfChainMarker", err)
+	}
+	return contents, nil
 }
 
 // ReadFAT reads a FAT entry.
+//
+// If the first FAT cannot be read, the other copies of
+// the FAT are tried in order.
 func (f *FS) ReadFAT(dataIndex uint32) (uint32, error) {
+	contents, _, err := f.ReadFATCopy(dataIndex)
+	return contents, err
+}
+
+// ReadFATCopy is like ReadFAT, but it also returns the
+// index of the FAT copy that the entry was read from.
+//
+// If every copy fails, the error from the first copy is
+// returned.
+func (f *FS) ReadFATCopy(dataIndex uint32) (contents uint32, copyIdx int, err error) {
 	sector, byteIdx := fatIndices(dataIndex)
-	block, err := f.Device.ReadSector(f.fatSectors[0] + sector)
+	block, copyIdx, err := f.readFATSectorCopy(sector)
 	if err != nil {
-		return 0, essentials.AddCtx("ReadFAT", err)
+		if len(f.fatSectors) == 0 {
+			return 0, 0, essentials.AddCtx("ReadFAT", err)
+		}
+		return 0, 0, &FSError{Op: "ReadFAT", Cluster: dataIndex,
+			Sector: f.fatSectors[0] + sector, Err: err}
 	}
-	return Endian.Uint32(block[byteIdx:byteIdx+4]) & 0x0fffffff, nil
+	return fatEntry(block, byteIdx), copyIdx, nil
 }
 
 // WriteFAT writes a FAT entry.
 func (f *FS) WriteFAT(dataIndex uint32, contents uint32) error {
+	if err := f.markDirty(); err != nil {
+		return essentials.AddCtx("WriteFAT", err)
+	}
 	sector, byteIdx := fatIndices(dataIndex)
-	for _, sectorOffset := range f.fatSectors {
-		block, err := f.Device.ReadSector(sector + sectorOffset)
-		if err != nil {
-			return essentials.AddCtx("WriteFAT", err)
+	var oldContents uint32
+	for i, sectorOffset := range f.fatSectors {
+		block, err := f.readSector(sector + sectorOffset)
+		if err == nil {
+			if i == 0 {
+				oldContents = fatEntry(block, byteIdx)
+			}
+			setFATEntry(block, byteIdx, contents)
+			err = f.writeSector(sector+sectorOffset, block)
 		}
-		oldContents := Endian.Uint32(block[byteIdx : byteIdx+4])
-		newContents := (contents & 0x0fffffff) | (oldContents & 0xf0000000)
-		Endian.PutUint32(block[byteIdx:byteIdx+4], newContents)
-		err = f.Device.WriteSector(sector+sectorOffset, block)
 		if err != nil {
-			return essentials.AddCtx("WriteFAT", err)
+			return &FSError{Op: "WriteFAT", Cluster: dataIndex,
+				Sector: sector + sectorOffset, Err: err}
+		}
+		if i == 0 {
+			f.setFATCacheSector(sector, block)
 		}
 	}
+	if contents == 0 && dataIndex >= 2 && dataIndex < f.allocCursor {
+		f.allocCursor = dataIndex
+	}
+	if dataIndex >= 2 {
+		f.updateRefs(oldContents, contents)
+	}
 	return nil
 }
 
 // Alloc allocates a cluster and marks it with an EOF in
 // the FAT.
+//
+// The search for a free cluster starts after the most
+// recently allocated cluster, or at the lowest cluster
+// freed since then, wrapping around if necessary.
 func (f *FS) Alloc() (dataIndex uint32, err error) {
 	defer essentials.AddCtxTo("Alloc", &err)
-	for i := uint32(0); i < f.BootSector.FatSz32(); i++ {
-		block, err := f.Device.ReadSector(i + f.fatSectors[0])
+	start := f.allocCursor
+	if start < 2 || start >= f.NumClusters() {
+		start = 2
+	}
+	dataIndex, err = f.findFree(start, f.NumClusters())
+	if err == ErrNoSpace && start > 2 {
+		dataIndex, err = f.findFree(2, start)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := f.WriteFAT(dataIndex, EOF); err != nil {
+		return 0, err
+	}
+	f.allocCursor = dataIndex + 1
+	return dataIndex, nil
+}
+
+// ResetAllocCursor makes the next Alloc search for a free
+// cluster starting at cluster 2, so that allocations fill
+// the volume from the beginning.
+func (f *FS) ResetAllocCursor() {
+	f.allocCursor = 2
+}
+
+// nextFreeHint reads the next free cluster hint from the
+// FSInfo sector.
+//
+// It returns 0 if the FSInfo sector cannot be read or the
+// hint is missing or out of range.
+func (f *FS) nextFreeHint() uint32 {
+	info, err := f.ReadFSInfo()
+	if err != nil || info.LeadSig != FSInfoLeadSig {
+		return 0
+	}
+	if info.NextFree < 2 || info.NextFree >= f.NumClusters() {
+		return 0
+	}
+	return info.NextFree
+}
+
+// findFreeClusters finds count free clusters without
+// allocating them, searching like Alloc does.
+func (f *FS) findFreeClusters(count int) ([]uint32, error) {
+	start := f.allocCursor
+	if start < 2 || start >= f.NumClusters() {
+		start = 2
+	}
+	var res []uint32
+	r := newFATReader(f)
+	for i := uint32(0); i < f.NumClusters()-2 && len(res) < count; i++ {
+		cluster := start + i
+		if cluster >= f.NumClusters() {
+			cluster -= f.NumClusters() - 2
+		}
+		contents, err := r.Read(cluster)
+		if err != nil {
+			return nil, err
+		}
+		if contents == 0 && (f.refCounts == nil || f.refCounts[cluster] == 0) {
+			res = append(res, cluster)
+		}
+	}
+	if len(res) < count {
+		return nil, ErrNoSpace
+	}
+	return res, nil
+}
+
+// writeFATEntries sets many FAT entries at once, writing
+// each affected FAT sector once.
+func (f *FS) writeFATEntries(entries map[uint32]uint32) error {
+	if err := f.markDirty(); err != nil {
+		return err
+	}
+	bySector := map[uint32][]uint32{}
+	var sectors []uint32
+	for cluster := range entries {
+		sector, _ := fatIndices(cluster)
+		if _, ok := bySector[sector]; !ok {
+			sectors = append(sectors, sector)
+		}
+		bySector[sector] = append(bySector[sector], cluster)
+	}
+	sort.Slice(sectors, func(i, j int) bool {
+		return sectors[i] < sectors[j]
+	})
+	for _, sector := range sectors {
+		block, err := f.readFATSector(sector)
+		if err != nil {
+			return err
+		}
+		updated := *block
+		for _, cluster := range bySector[sector] {
+			_, byteIdx := fatIndices(cluster)
+			setFATEntry(&updated, byteIdx, entries[cluster])
+		}
+		if err := f.WriteFATSector(sector, &updated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findFree finds the first free cluster in [start, end).
+func (f *FS) findFree(start, end uint32) (uint32, error) {
+	r := newFATReader(f)
+	for i := start; i < end; i++ {
+		contents, err := r.Read(i)
 		if err != nil {
 			return 0, err
 		}
-		for j := 0; j < 128; j++ {
-			clusterIdx := uint32(j) + i*128
-			if clusterIdx < 2 || clusterIdx >= f.NumClusters() {
-				continue
-			}
-			contents := Endian.Uint32(block[j*4:(j+1)*4]) & 0x0fffffff
-			if contents == 0 {
-				return clusterIdx, f.WriteFAT(clusterIdx, EOF)
-			}
+		if contents == 0 && (f.refCounts == nil || f.refCounts[i] == 0) {
+			return i, nil
+		}
+	}
+	return 0, ErrNoSpace
+}
+
+// EnableCrossLinkCheck makes Alloc skip free clusters
+// which other FAT entries point to.
+//
+// In a corrupt FAT, such a cluster may be in the middle
+// of another chain even though it is marked as free, and
+// allocating it would cross-link the two chains.
+//
+// This scans the FAT to count the references to every
+// cluster, using one byte of memory per cluster.
+// The counts are kept up to date as the FAT is modified
+// through the FS, and calling this again rescans the FAT.
+func (f *FS) EnableCrossLinkCheck() error {
+	counts := make([]uint8, f.NumClusters())
+	r := newFATReader(f)
+	for cluster := uint32(2); cluster < f.NumClusters(); cluster++ {
+		next, err := r.Read(cluster)
+		if err != nil {
+			return essentials.AddCtx("EnableCrossLinkCheck", err)
+		}
+		if next >= 2 && next < f.NumClusters() && counts[next] < 255 {
+			counts[next]++
+		}
+	}
+	f.refCounts = counts
+	return nil
+}
+
+// DisableCrossLinkCheck turns off the check enabled by
+// EnableCrossLinkCheck.
+func (f *FS) DisableCrossLinkCheck() {
+	f.refCounts = nil
+}
+
+// updateRefs updates the reference counts when a FAT
+// entry changes from oldNext to newNext.
+//
+// Saturated counts are never decremented, since the true
+// count is unknown.
+func (f *FS) updateRefs(oldNext, newNext uint32) {
+	if f.refCounts == nil || oldNext == newNext {
+		return
+	}
+	if oldNext >= 2 && oldNext < uint32(len(f.refCounts)) {
+		if count := f.refCounts[oldNext]; count > 0 && count < 255 {
+			f.refCounts[oldNext]--
 		}
 	}
-	return 0, errors.New("no free clusters")
+	if newNext >= 2 && newNext < uint32(len(f.refCounts)) && f.refCounts[newNext] < 255 {
+		f.refCounts[newNext]++
+	}
+}
+
+// LoadFAT reads the entire FAT into memory, so that FAT
+// entries can be read without accessing the device.
+//
+// This uses FatSz32*512 bytes of memory, which is about
+// 4 bytes for every cluster on the volume.
+//
+// Writes through the FS still go to every copy of the FAT
+// on the device, and they also update the loaded FAT.
+// The loaded FAT becomes stale if the device is modified
+// by other means.
+func (f *FS) LoadFAT() error {
+	cache := make([]*Sector, f.BootSector.FatSz32())
+	for i := range cache {
+		sector, err := f.readFATSector(uint32(i))
+		if err != nil {
+			return essentials.AddCtx("LoadFAT", err)
+		}
+		cache[i] = sector
+	}
+	f.fatCache = cache
+	f.fatCacheShared = false
+	return nil
+}
+
+// UnloadFAT releases the memory used by LoadFAT, so that
+// FAT entries are read from the device again.
+func (f *FS) UnloadFAT() {
+	f.fatCache = nil
+}
+
+// ReadFATSector reads a sector of the FAT, where n is
+// relative to the start of the FAT.
+// Sector n holds the 128 entries starting with the entry
+// for cluster n*128.
+//
+// Like ReadFAT, this falls back on the other copies of
+// the FAT if the first one cannot be read.
+func (f *FS) ReadFATSector(n uint32) (*Sector, error) {
+	if n >= f.BootSector.FatSz32() {
+		return nil, essentials.AddCtx("ReadFATSector", errors.New("sector out of range"))
+	}
+	sector, err := f.readFATSector(n)
+	if err != nil {
+		return nil, essentials.AddCtx("ReadFATSector", err)
+	}
+	return sector, nil
+}
+
+// WriteFATSector writes a sector of the FAT to every copy
+// of the FAT, where n is relative to the start of the FAT.
+//
+// Unlike WriteFAT, this does not preserve the reserved
+// high 4 bits of each entry.
+func (f *FS) WriteFATSector(n uint32, s *Sector) error {
+	if n >= f.BootSector.FatSz32() {
+		return essentials.AddCtx("WriteFATSector", errors.New("sector out of range"))
+	}
+	if err := f.markDirty(); err != nil {
+		return essentials.AddCtx("WriteFATSector", err)
+	}
+	var old *Sector
+	if f.refCounts != nil {
+		var err error
+		old, err = f.readFATSector(n)
+		if err != nil {
+			return essentials.AddCtx("WriteFATSector", err)
+		}
+	}
+	for i, offset := range f.fatSectors {
+		if err := f.writeSector(offset+n, s); err != nil {
+			return essentials.AddCtx("WriteFATSector", err)
+		}
+		if i == 0 {
+			f.setFATCacheSector(n, s)
+		}
+	}
+	for i := 0; i < 128; i++ {
+		cluster := n*128 + uint32(i)
+		if cluster < 2 {
+			continue
+		}
+		if cluster < f.allocCursor && fatEntry(s, i*4) == 0 {
+			f.allocCursor = cluster
+		}
+		if old != nil {
+			f.updateRefs(fatEntry(old, i*4), fatEntry(s, i*4))
+		}
+	}
+	return nil
+}
+
+// setFATCacheSector replaces a sector of the loaded FAT,
+// if the FAT is loaded, once it has been written to the
+// first FAT on the device.
+func (f *FS) setFATCacheSector(n uint32, s *Sector) {
+	if f.fatCache == nil {
+		return
+	}
+	if f.fatCacheShared {
+		f.fatCache = append([]*Sector{}, f.fatCache...)
+		f.fatCacheShared = false
+	}
+	sector := *s
+	f.fatCache[n] = &sector
+}
+
+// readFATSector reads a sector of the FAT, where n is
+// relative to the start of the FAT.
+func (f *FS) readFATSector(n uint32) (*Sector, error) {
+	block, _, err := f.readFATSectorCopy(n)
+	return block, err
+}
+
+// readFATSectorCopy reads a sector of the FAT, falling
+// back on the other FAT copies if a read fails.
+//
+// If the FAT is loaded, the sector comes from memory.
+func (f *FS) readFATSectorCopy(n uint32) (block *Sector, copyIdx int, err error) {
+	if f.fatCache != nil && !f.closed {
+		sector := *f.fatCache[n]
+		return &sector, 0, nil
+	}
+	var firstErr error
+	for i, offset := range f.fatSectors {
+		block, err := f.readSector(offset + n)
+		if err == nil {
+			return block, i, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no FATs")
+	}
+	return nil, 0, firstErr
+}
+
+func (f *FS) readSector(idx uint32) (*Sector, error) {
+	if f.closed {
+		return nil, ErrClosed
+	}
+	if f.OnSectorRead != nil {
+		f.OnSectorRead(idx)
+	}
+	return f.Device.ReadSector(idx)
+}
+
+func (f *FS) writeSector(idx uint32, value *Sector) error {
+	if f.closed {
+		return ErrClosed
+	}
+	if err := f.markDirty(); err != nil {
+		return err
+	}
+	if f.OnSectorWrite != nil {
+		f.OnSectorWrite(idx)
+	}
+	return f.Device.WriteSector(idx, value)
+}
+
+// sectorsZero checks if a range of sectors is known to
+// be zero, which is only the case if the device is a
+// ZeroReporter.
+func (f *FS) sectorsZero(start, count uint32) (bool, error) {
+	if f.closed {
+		return false, ErrClosed
+	}
+	if reporter, ok := f.Device.(ZeroReporter); ok {
+		return reporter.SectorsZero(start, count)
+	}
+	return false, nil
+}
+
+// markDirty clears the clean shutdown bit in the FAT, if
+// it is set, before the first write to the volume.
+//
+// Methods which modify FAT sectors call this before they
+// read them, so that the sectors they write back are not
+// missing the change.
+func (f *FS) markDirty() error {
+	if f.dirty || f.closed {
+		return nil
+	}
+	f.dirty = true
+	flags, err := f.ReadFAT(1)
+	if err != nil {
+		return err
+	}
+	if flags&cleanShutdownBit == 0 {
+		return nil
+	}
+	return f.WriteFAT(1, flags&^cleanShutdownBit)
+}
+
+// A fatReader reads FAT entries during a traversal,
+// caching the FAT sector it read most recently.
+//
+// Since the cache is not updated by FS.WriteFAT, a
+// fatReader should only be used for a single operation,
+// and any FAT entries which that operation writes must be
+// reported with Set.
+type fatReader struct {
+	fs     *FS
+	sector uint32
+	block  *Sector
+}
+
+func newFATReader(fs *FS) *fatReader {
+	return &fatReader{fs: fs}
+}
+
+// Read reads a FAT entry.
+func (r *fatReader) Read(dataIndex uint32) (uint32, error) {
+	sector, byteIdx := fatIndices(dataIndex)
+	if r.block == nil || r.sector != sector {
+		block, err := r.fs.readFATSector(sector)
+		if err != nil {
+			return 0, essentials.AddCtx("ReadFAT", err)
+		}
+		r.sector = sector
+		r.block = block
+	}
+	return fatEntry(r.block, byteIdx), nil
+}
+
+// Set updates the cache to reflect a FAT write.
+func (r *fatReader) Set(dataIndex, contents uint32) {
+	sector, byteIdx := fatIndices(dataIndex)
+	if r.block != nil && r.sector == sector {
+		setFATEntry(r.block, byteIdx, contents)
+	}
 }
 
 func fatIndices(dataIndex uint32) (uint32, int) {
@@ -146,11 +1215,70 @@ func fatIndices(dataIndex uint32) (uint32, int) {
 	return sector, int(sectorIdx) * 4
 }
 
-func fsInfoSector() *Sector {
-	var res Sector
-	Endian.PutUint32(res[0:4], 0x41615252)
-	Endian.PutUint32(res[488:492], 0xffffffff)
-	Endian.PutUint32(res[492:496], 0xffffffff)
-	Endian.PutUint32(res[508:], 0xAA550000)
-	return &res
+// fatEntry reads a FAT entry from a FAT sector, ignoring
+// the reserved high 4 bits.
+func fatEntry(block *Sector, byteIdx int) uint32 {
+	return Endian.Uint32(block[byteIdx:byteIdx+4]) & 0x0fffffff
+}
+
+// setFATEntry writes a FAT entry into a FAT sector.
+//
+// The reserved high 4 bits of the entry are preserved.
+// All code that modifies the FAT should go through this
+// function.
+func setFATEntry(block *Sector, byteIdx int, contents uint32) {
+	oldContents := Endian.Uint32(block[byteIdx : byteIdx+4])
+	newContents := (contents & 0x0fffffff) | (oldContents & 0xf0000000)
+	Endian.PutUint32(block[byteIdx:byteIdx+4], newContents)
+}
+
+// selfTest checks that the cluster and FAT addressing
+// arithmetic is consistent with the volume's geometry.
+//
+// For a sample of clusters, it verifies that each cluster
+// lies within the data region and the device, and that
+// its FAT entry lies within every copy of the FAT.
+func (f *FS) selfTest() error {
+	b := f.BootSector
+	firstData, dataSectors := f.DataRegion()
+	if firstData+dataSectors > f.Device.NumSectors() {
+		return errors.New("data region extends past the device")
+	}
+	if uint64(f.NumClusters())*4 > uint64(b.FatSz32())*SectorSize {
+		return errors.New("FAT is too small for all clusters")
+	}
+	fatStart := uint32(b.RsvdSecCnt())
+	for i, offset := range f.fatSectors {
+		if offset != fatStart+uint32(i)*b.FatSz32() {
+			return fmt.Errorf("FAT %d starts at unexpected sector %d", i, offset)
+		}
+	}
+	if fatStart+uint32(len(f.fatSectors))*b.FatSz32() != firstData {
+		return errors.New("FATs do not end at the data region")
+	}
+
+	numClusters := f.NumClusters()
+	samples := []uint32{2, 3, numClusters / 2, numClusters - 2, numClusters - 1}
+	for c := uint32(2); c < numClusters; c += 4099 {
+		samples = append(samples, c)
+	}
+	secPerClus := uint32(b.SecPerClus())
+	for _, cluster := range samples {
+		if cluster < 2 || cluster >= numClusters {
+			continue
+		}
+		sector, err := NewChain(f, cluster).clusterSector()
+		if err != nil {
+			return fmt.Errorf("cluster %d: %s", cluster, err)
+		}
+		if sector < firstData || sector+secPerClus > firstData+dataSectors {
+			return fmt.Errorf("cluster %d: sector %d is outside the data region", cluster,
+				sector)
+		}
+		fatSector, byteIdx := fatIndices(cluster)
+		if fatSector >= b.FatSz32() || byteIdx+4 > SectorSize {
+			return fmt.Errorf("cluster %d: FAT entry is outside the FAT", cluster)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,50 @@
+package fatfs
+
+import "github.com/unixpickle/essentials"
+
+// An FSError is returned when reading or writing the
+// device fails, recording where the failure happened.
+//
+// It is returned by ReadFAT, WriteFAT, ReadCluster, and
+// WriteCluster, among others.
+type FSError struct {
+	// Op is the operation that failed, such as "ReadFAT".
+	Op string
+
+	// Cluster is the cluster being accessed, or the FAT
+	// entry being accessed for FAT operations.
+	Cluster uint32
+
+	// Sector is the device sector which failed.
+	Sector uint32
+
+	// Err is the error from the device.
+	Err error
+}
+
+// Error returns the device error, prefixed by Op.
+func (f *FSError) Error() string {
+	if f.Op == "" {
+		return f.Err.Error()
+	}
+	return f.Op + ": " + f.Err.Error()
+}
+
+// Unwrap returns the device error.
+func (f *FSError) Unwrap() error {
+	return f.Err
+}
+
+// addErrorOp is like essentials.AddCtxTo, except that an
+// *FSError without an operation is given op instead of
+// being wrapped.
+func addErrorOp(op string, err *error) {
+	if *err == nil {
+		return
+	}
+	if fsErr, ok := (*err).(*FSError); ok && fsErr.Op == "" {
+		fsErr.Op = op
+		return
+	}
+	*err = essentials.AddCtx(op, *err)
+}
@@ -0,0 +1,195 @@
+package fatfs
+
+import (
+	"errors"
+
+	"github.com/unixpickle/essentials"
+)
+
+// Signatures which identify an FSInfo sector.
+const (
+	FSInfoLeadSig  = 0x41615252
+	FSInfoStrucSig = 0x61417272
+	FSInfoTrailSig = 0xAA550000
+)
+
+// FSInfoUnknown is stored in the FreeCount or NextFree
+// field of an FSInfo sector when the value is unknown.
+const FSInfoUnknown = 0xffffffff
+
+// FSInfo holds the fields of a FAT32 FSInfo sector, which
+// caches information about free clusters.
+type FSInfo struct {
+	LeadSig  uint32
+	StrucSig uint32
+
+	// FreeCount is the last known number of free clusters.
+	FreeCount uint32
+
+	// NextFree is a hint for where to start looking for
+	// free clusters.
+	NextFree uint32
+
+	TrailSig uint32
+}
+
+// Valid checks that all of the signatures are correct.
+func (f *FSInfo) Valid() bool {
+	return f.LeadSig == FSInfoLeadSig && f.StrucSig == FSInfoStrucSig &&
+		f.TrailSig == FSInfoTrailSig
+}
+
+// ReadFSInfo reads the FSInfo sector.
+func (f *FS) ReadFSInfo() (*FSInfo, error) {
+	idx, err := f.fsInfoIndex(false)
+	if err != nil {
+		return nil, essentials.AddCtx("ReadFSInfo", err)
+	}
+	sector, err := f.readSector(idx)
+	if err != nil {
+		return nil, essentials.AddCtx("ReadFSInfo", err)
+	}
+	return decodeFSInfo(sector), nil
+}
+
+// ReadBackupFSInfo reads the copy of the FSInfo sector
+// which follows the backup boot sector.
+func (f *FS) ReadBackupFSInfo() (*FSInfo, error) {
+	idx, err := f.fsInfoIndex(true)
+	if err != nil {
+		return nil, essentials.AddCtx("ReadBackupFSInfo", err)
+	}
+	sector, err := f.readSector(idx)
+	if err != nil {
+		return nil, essentials.AddCtx("ReadBackupFSInfo", err)
+	}
+	return decodeFSInfo(sector), nil
+}
+
+// WriteFSInfo writes the fields of the FSInfo sector.
+// The rest of the sector is left unchanged.
+//
+// The backup copy is not updated; see BackupFSInfo.
+func (f *FS) WriteFSInfo(info *FSInfo) (err error) {
+	defer essentials.AddCtxTo("WriteFSInfo", &err)
+	idx, err := f.fsInfoIndex(false)
+	if err != nil {
+		return err
+	}
+	sector, err := f.readSector(idx)
+	if err != nil {
+		return err
+	}
+	info.encode(sector)
+	return f.writeSector(idx, sector)
+}
+
+// BackupFSInfo copies the FSInfo sector to its backup
+// location.
+func (f *FS) BackupFSInfo() error {
+	return essentials.AddCtx("BackupFSInfo", f.copyFSInfo(false, true))
+}
+
+// RestoreFSInfo replaces the FSInfo sector with its backup
+// copy.
+func (f *FS) RestoreFSInfo() error {
+	return essentials.AddCtx("RestoreFSInfo", f.copyFSInfo(true, false))
+}
+
+func (f *FS) copyFSInfo(fromBackup, toBackup bool) error {
+	source, err := f.fsInfoIndex(fromBackup)
+	if err != nil {
+		return err
+	}
+	dest, err := f.fsInfoIndex(toBackup)
+	if err != nil {
+		return err
+	}
+	sector, err := f.readSector(source)
+	if err != nil {
+		return err
+	}
+	return f.writeSector(dest, sector)
+}
+
+// BackupRegionDevice gets a view of the backup boot
+// region, which starts at the backup boot sector.
+//
+// The view has the same layout as the start of the
+// volume, so sector 0 is the backup boot sector and the
+// backup FSInfo sector is at the index given by the boot
+// sector's FSInfo field.
+// It covers BkBootSec sectors, mirroring the sectors
+// before the backup, but it is cut short if it would pass
+// the end of the reserved region.
+//
+// The view reads and writes the device directly, so it
+// can be used to repair the backups.
+func (f *FS) BackupRegionDevice() (BlockDevice, error) {
+	b := f.BootSector
+	start := uint32(b.BkBootSec())
+	if start == 0 || start == 0xffff {
+		return nil, errors.New("BackupRegionDevice: volume has no backup boot sector")
+	}
+	reserved := uint32(b.RsvdSecCnt())
+	if start >= reserved {
+		return nil, errors.New("BackupRegionDevice: backup boot sector is outside the " +
+			"reserved region")
+	}
+	count := start
+	if start+count > reserved {
+		count = reserved - start
+	}
+	return &OffsetDevice{Device: f.Device, Start: start, Count: count}, nil
+}
+
+// fsInfoIndex gets the sector index of the FSInfo sector
+// or its backup, checking that it is a reserved sector.
+func (f *FS) fsInfoIndex(backup bool) (uint32, error) {
+	b := f.BootSector
+	idx := uint32(b.FSInfo())
+	if idx == 0 || idx == 0xffff {
+		return 0, errors.New("volume has no FSInfo sector")
+	}
+	if backup {
+		if b.BkBootSec() == 0 || b.BkBootSec() == 0xffff {
+			return 0, errors.New("volume has no backup boot sector")
+		}
+		idx += uint32(b.BkBootSec())
+	}
+	if idx >= uint32(b.RsvdSecCnt()) {
+		return 0, errors.New("FSInfo sector is outside the reserved region")
+	}
+	return idx, nil
+}
+
+func decodeFSInfo(s *Sector) *FSInfo {
+	return &FSInfo{
+		LeadSig:   Endian.Uint32(s[0:4]),
+		StrucSig:  Endian.Uint32(s[484:488]),
+		FreeCount: Endian.Uint32(s[488:492]),
+		NextFree:  Endian.Uint32(s[492:496]),
+		TrailSig:  Endian.Uint32(s[508:512]),
+	}
+}
+
+func (f *FSInfo) encode(s *Sector) {
+	Endian.PutUint32(s[0:4], f.LeadSig)
+	Endian.PutUint32(s[484:488], f.StrucSig)
+	Endian.PutUint32(s[488:492], f.FreeCount)
+	Endian.PutUint32(s[492:496], f.NextFree)
+	Endian.PutUint32(s[508:512], f.TrailSig)
+}
+
+func fsInfoSector() *Sector {
+	var res Sector
+	info := &FSInfo{
+		LeadSig:   FSInfoLeadSig,
+		StrucSig:  FSInfoStrucSig,
+		FreeCount: FSInfoUnknown,
+		NextFree:  FSInfoUnknown,
+		TrailSig:  FSInfoTrailSig,
+	}
+	info.encode(&res)
+	return &res
+}
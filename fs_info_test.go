@@ -0,0 +1,127 @@
+package fatfs
+
+import "testing"
+
+func TestFSInfo(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.ReadFSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Valid() || info.FreeCount != FSInfoUnknown || info.NextFree != FSInfoUnknown {
+		t.Errorf("unexpected FSInfo: %+v", info)
+	}
+	if err := fs.BackupFSInfo(); err == nil {
+		t.Error("expected error without a backup boot sector")
+	}
+
+	// Use a layout with a backup boot sector at sector 6.
+	bs, err := NewBootSector32(dev.NumSectors(), "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.SetRsvdSecCnt(32)
+	bs.SetBkBootSec(6)
+	sector := Sector(*bs)
+	if err := dev.WriteSector(0, &sector); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.BackupFSInfo(); err != nil {
+		t.Fatal(err)
+	}
+	info.FreeCount = 1234
+	info.NextFree = 56
+	if err := fs.WriteFSInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := fs.ReadBackupFSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Valid() || backup.FreeCount != FSInfoUnknown {
+		t.Errorf("unexpected backup: %+v", backup)
+	}
+	if primary, err := fs.ReadFSInfo(); err != nil {
+		t.Fatal(err)
+	} else if *primary != *info {
+		t.Errorf("expected %+v but got %+v", info, primary)
+	}
+
+	if err := fs.RestoreFSInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if primary, err := fs.ReadFSInfo(); err != nil {
+		t.Fatal(err)
+	} else if *primary != *backup {
+		t.Errorf("expected %+v but got %+v", backup, primary)
+	}
+}
+
+func TestBackupRegionDevice(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFSWithOptions(dev, &FormatOptions{Label: "FOO", ReservedSectors: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.BackupRegionDevice(); err == nil {
+		t.Error("expected error without a backup boot sector")
+	}
+
+	fs.BootSector.SetBkBootSec(6)
+	sector := Sector(*fs.BootSector)
+	for _, idx := range []uint32{0, 6} {
+		if err := dev.WriteSector(idx, &sector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.BackupFSInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := fs.BackupRegionDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.NumSectors() != 6 {
+		t.Errorf("expected 6 sectors but got %d", backup.NumSectors())
+	}
+	if bs, err := backup.ReadSector(0); err != nil {
+		t.Fatal(err)
+	} else if *bs != sector {
+		t.Error("unexpected backup boot sector")
+	}
+	infoSector, err := backup.ReadSector(uint32(fs.BootSector.FSInfo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := decodeFSInfo(infoSector)
+	if !info.Valid() {
+		t.Fatalf("unexpected backup FSInfo: %+v", info)
+	}
+	info.FreeCount = 1234
+	info.encode(infoSector)
+	if err := backup.WriteSector(uint32(fs.BootSector.FSInfo()), infoSector); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := fs.ReadBackupFSInfo(); err != nil {
+		t.Fatal(err)
+	} else if actual.FreeCount != 1234 {
+		t.Errorf("unexpected backup free count: %d", actual.FreeCount)
+	}
+	if primary, err := fs.ReadFSInfo(); err != nil {
+		t.Fatal(err)
+	} else if primary.FreeCount == 1234 {
+		t.Error("primary FSInfo was modified")
+	}
+	if _, err := backup.ReadSector(6); err == nil {
+		t.Error("expected error reading past the region")
+	}
+}
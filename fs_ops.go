@@ -1,30 +1,64 @@
 package fatfs
 
 import (
+	"errors"
+	"io"
+	"os"
 	"time"
 
 	"github.com/unixpickle/essentials"
 )
 
 // Mkdir creates an empty directory.
+// The name must pass ValidateName.
+// If date is the zero time, the FS clock is used.
+//
+// If the parent already has an entry matching the name
+// (as in Dir.Lookup), ErrExist is returned.
 func Mkdir(parent *Dir, name string, date time.Time) (d *Dir, err error) {
 	defer essentials.AddCtxTo("Mkdir", &err)
+	shortNames, err := checkNewName(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	if date.IsZero() {
+		date = parent.Chain.FS().now()
+	}
+	entry, err := shortNames.unique(name, NewDirEntry(name, 0, 0, date, true))
+	if err != nil {
+		return nil, err
+	}
+	return mkdir(parent, entry)
+}
 
+// mkdir creates an empty directory for an entry, filling
+// in the entry's first cluster.
+//
+// The "." and ".." entries get the same attributes and
+// timestamps as the new entry.
+func mkdir(parent *Dir, entry DirEntry) (*Dir, error) {
 	fs := parent.Chain.FS()
-	dirCluster, err := fs.Alloc()
+	chain, err := fs.NewChainAlloc()
 	if err != nil {
 		return nil, err
 	}
-	chain := NewChain(fs, dirCluster)
+	dirCluster := chain.FirstCluster()
+	entry.Raw().SetFirstCluster(dirCluster)
+
+	dot := *entry.Raw()
+	copy(dot.Name(), ".          ")
+	dotDot := dot
+	copy(dotDot.Name(), "..         ")
+	dotDot.SetFirstCluster(parent.Chain.FirstCluster())
+
 	clusterData := make([]byte, fs.ClusterSize())
-	copy(clusterData, NewRawDirEntry(".          ", dirCluster, 0, date, true)[:])
-	copy(clusterData[32:], NewRawDirEntry("..         ", parent.Chain.FirstCluster(), 0, date,
-		true)[:])
+	copy(clusterData, dot[:])
+	copy(clusterData[32:], dotDot[:])
 	if err := chain.WriteCluster(clusterData); err != nil {
+		fs.WriteFAT(dirCluster, 0)
 		return nil, err
 	}
 
-	entry := NewDirEntry(name, dirCluster, 0, date, true)
 	if err := parent.AddEntry(entry); err != nil {
 		fs.WriteFAT(dirCluster, 0)
 		return nil, err
@@ -33,6 +67,75 @@ func Mkdir(parent *Dir, name string, date time.Time) (d *Dir, err error) {
 	return NewDir(chain), nil
 }
 
+// CreateFile creates a regular file containing the data
+// from r.
+// The file's archive attribute is set, and the name must
+// pass ValidateName.
+//
+// As with Mkdir, ErrExist is returned if the name matches
+// an existing entry, even if only case-insensitively, and
+// the FS clock is used if date is the zero time.
+//
+// If r is empty, no clusters are allocated for the file,
+// and its first cluster is recorded as 0.
+func CreateFile(parent *Dir, name string, r io.Reader, date time.Time) (f *File, err error) {
+	defer essentials.AddCtxTo("CreateFile", &err)
+	shortNames, err := checkNewName(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	if date.IsZero() {
+		date = parent.Chain.FS().now()
+	}
+
+	chain := NewChain(parent.Chain.FS(), 0)
+	size, err := chain.ReadFrom(r)
+	if err != nil {
+		chain.Free()
+		return nil, err
+	}
+	if size >= 1<<32 {
+		chain.Free()
+		return nil, errors.New("file is too large")
+	}
+
+	entry, err := shortNames.unique(name,
+		NewDirEntry(name, chain.FirstCluster(), uint32(size), date, false))
+	if err != nil {
+		chain.Free()
+		return nil, err
+	}
+	entry.Raw().SetAttr(Archive)
+	if err := parent.AddEntry(entry); err != nil {
+		chain.Free()
+		return nil, err
+	}
+
+	return NewFile(chain, size), nil
+}
+
+// checkNewName checks that a name is valid and is not
+// already used in the parent directory, and returns the
+// short names used in the parent.
+//
+// Since FAT names are case-insensitive, a name is in use
+// if Dir.Lookup would find it.
+func checkNewName(parent *Dir, name string) (shortNames *shortNameSet, err error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	listing, err := parent.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range listing {
+		if !entry.Raw().IsDotPointer() && entry.matchesName(name) {
+			return nil, os.ErrExist
+		}
+	}
+	return shortNamesOf(listing), nil
+}
+
 // Remove deletes a file or directory.
 // It uses recursion if necessary.
 func Remove(parent *Dir, name string) (err error) {
@@ -42,7 +145,7 @@ func Remove(parent *Dir, name string) (err error) {
 		return err
 	}
 	chain := NewChain(parent.Chain.FS(), entry.Raw().FirstCluster())
-	if entry.Raw().Attr()&Directory == Directory {
+	if entry.Raw().IsDir() {
 		dir := NewDir(chain)
 		listing, err := dir.ReadDir()
 		if err != nil {
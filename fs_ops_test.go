@@ -1,6 +1,13 @@
 package fatfs
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
 	"time"
 )
@@ -49,3 +56,179 @@ func TestRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateFile(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(RootDirChain(fs))
+
+	empty, err := CreateFile(dir, "empty.txt", bytes.NewReader(nil), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Size != 0 || empty.Chain.FirstCluster() != 0 {
+		t.Errorf("unexpected empty file: size=%d cluster=%d", empty.Size,
+			empty.Chain.FirstCluster())
+	}
+	if _, err := empty.ReadAt(make([]byte, 1), 0); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+
+	contents := make([]byte, 10000)
+	rand.Read(contents)
+	file, err := CreateFile(dir, "data.bin", bytes.NewReader(contents), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Chain.FirstCluster() != 3 {
+		t.Errorf("expected first cluster 3 but got %d", file.Chain.FirstCluster())
+	}
+
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 2 {
+		t.Fatalf("unexpected listing: %v", listing)
+	}
+	if listing[0].Raw().FirstCluster() != 0 || listing[0].Raw().FileSize() != 0 {
+		t.Error("unexpected empty file entry")
+	}
+	if listing[1].Raw().FileSize() != uint32(len(contents)) {
+		t.Errorf("unexpected size: %d", listing[1].Raw().FileSize())
+	}
+	reopened := NewFile(NewChain(fs, listing[1].Raw().FirstCluster()),
+		int64(listing[1].Raw().FileSize()))
+	actual := make([]byte, len(contents))
+	if _, err := reopened.ReadAt(actual, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, contents) {
+		t.Error("data mismatch")
+	}
+
+	if err := empty.Chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	if empty.Chain.FirstCluster() != 6 {
+		t.Errorf("expected first cluster 6 but got %d", empty.Chain.FirstCluster())
+	}
+}
+
+func TestEmptyChain(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, 0)
+	if offset, err := chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if offset != 0 {
+		t.Errorf("unexpected offset: %d", offset)
+	}
+	if n, err := chain.WriteTo(ioutil.Discard); err != nil || n != 0 {
+		t.Errorf("unexpected WriteTo result: %d, %v", n, err)
+	}
+	if data, err := chain.ReadAll(0); err != nil || len(data) != 0 {
+		t.Errorf("unexpected ReadAll result: %v, %v", data, err)
+	}
+	if err := chain.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := fs.ReadFAT(0); err != nil {
+		t.Fatal(err)
+	} else if contents != EOF {
+		t.Errorf("FAT[0] was modified: 0x%x", contents)
+	}
+	if err := chain.SetClusters([][]byte{make([]byte, fs.ClusterSize())}); err != nil {
+		t.Fatal(err)
+	}
+	if chain.FirstCluster() != 3 {
+		t.Errorf("expected first cluster 3 but got %d", chain.FirstCluster())
+	}
+	if offset, err := chain.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if offset != 0 {
+		t.Errorf("unexpected offset: %d", offset)
+	}
+}
+
+func TestCreateCollision(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(fs.RootDir())
+	if _, err := CreateFile(dir, "README.TXT", bytes.NewReader(nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Mkdir(dir, "My Documents", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	shortName := UnformatName(FormatName("My Documents"))
+	for _, name := range []string{"ReadMe.txt", "readme.txt", "my documents", shortName} {
+		if _, err := CreateFile(dir, name, bytes.NewReader(nil), time.Now()); !errors.Is(err, os.ErrExist) {
+			t.Errorf("CreateFile %q: expected ErrExist but got %v", name, err)
+		}
+		if _, err := Mkdir(dir, name, time.Now()); !errors.Is(err, os.ErrExist) {
+			t.Errorf("Mkdir %q: expected ErrExist but got %v", name, err)
+		}
+	}
+	entries, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries but got %d", len(entries))
+	}
+}
+
+func TestCreateShortNameCollision(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewDir(fs.RootDir())
+	names := []string{"My Documents", "My Documents2", "My Documents3"}
+	for _, name := range names {
+		if _, err := Mkdir(dir, name, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("long file name %d.txt", i)
+		if _, err := CreateFile(dir, name, bytes.NewReader(nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	listing, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortNames := map[string]bool{}
+	for _, entry := range listing {
+		short := string(entry.Raw().Name())
+		if shortNames[short] {
+			t.Errorf("duplicate short name %q", short)
+		}
+		shortNames[short] = true
+	}
+	for _, name := range names {
+		if _, err := dir.Lookup(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if entry, err := dir.Lookup("MY DOC~1"); err != nil {
+		t.Error(err)
+	} else if entry.Name() != "My Documents2" {
+		t.Errorf("unexpected entry for MY DOC~1: %s", entry.Name())
+	}
+}
@@ -1,7 +1,12 @@
 package fatfs
 
 import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFormatFS(t *testing.T) {
@@ -10,6 +15,9 @@ func TestFormatFS(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err := FormatFSWithOptions(dev, nil); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAlloc(t *testing.T) {
@@ -31,3 +39,1217 @@ func TestAlloc(t *testing.T) {
 		t.Fatal("expected allocation failure")
 	}
 }
+
+func TestSync(t *testing.T) {
+	dev := &syncCounter{RAMDisk: make(RAMDisk, 4096*80000)}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.syncs != 1 {
+		t.Errorf("expected 1 sync but got %d", dev.syncs)
+	}
+
+	fs.Device = dev.RAMDisk
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type syncCounter struct {
+	RAMDisk
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestSectorHooks(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reads, writes []uint32
+	fs.OnSectorRead = func(sector uint32) {
+		reads = append(reads, sector)
+	}
+	fs.OnSectorWrite = func(sector uint32) {
+		writes = append(writes, sector)
+	}
+
+	if _, err := RootDirChain(fs).ReadCluster(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reads) != int(fs.BootSector.SecPerClus()) || len(writes) != 0 {
+		t.Errorf("unexpected accesses: reads=%v writes=%v", reads, writes)
+	}
+	firstData := uint32(fs.BootSector.RsvdSecCnt()) +
+		uint32(fs.BootSector.NumFATs())*fs.BootSector.FatSz32()
+	for i, sector := range reads {
+		if sector != firstData+uint32(i) {
+			t.Errorf("read %d: expected sector %d but got %d", i, firstData+uint32(i), sector)
+		}
+	}
+
+	reads, writes = nil, nil
+	if err := fs.WriteFAT(3, EOF); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != int(fs.BootSector.NumFATs()) {
+		t.Errorf("unexpected writes: %v", writes)
+	}
+}
+
+func TestNewFSGeometry(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	if _, err := FormatFS(dev, "FOO", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFS(dev); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFS(dev[:len(dev)/2]); err == nil {
+		t.Error("expected error for truncated device")
+	}
+
+	original, err := dev.ReadSector(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range []func(b *BootSector){
+		func(b *BootSector) { b.SetSecPerClus(0) },
+		func(b *BootSector) { b.SetFatSz32(b.FatSz32() / 2) },
+		func(b *BootSector) { b.SetNumFATs(0) },
+		func(b *BootSector) { b.SetBytesPerSec(4096) },
+	} {
+		bs := BootSector(*original)
+		corrupt(&bs)
+		sec := Sector(bs)
+		if err := dev.WriteSector(0, &sec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFS(dev); err == nil {
+			t.Error("expected error for corrupt geometry")
+		}
+	}
+}
+
+func TestFATHighBits(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sector := range fs.fatSectors {
+		block, err := dev.ReadSector(sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block[7] |= 0xa0
+		if err := dev.WriteSector(sector, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain := RootDirChain(fs)
+	for i := 0; i < 200; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFAT(1, EOF); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sector := range fs.fatSectors {
+		block, err := dev.ReadSector(sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block[7]&0xf0 != 0xa0 {
+			t.Errorf("sector %d: high bits of FAT[1] were lost", sector)
+		}
+	}
+	if contents, err := fs.ReadFAT(1); err != nil {
+		t.Fatal(err)
+	} else if contents != EOF {
+		t.Errorf("unexpected FAT[1]: 0x%x", contents)
+	}
+}
+
+func TestSetVolumeLabel(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetVolumeLabel("backup 2"); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label := string(fs.BootSector.VolLab()); label != "BACKUP 2   " {
+		t.Errorf("unexpected label: %q", label)
+	}
+
+	for _, label := range []string{"café", "TOO LONG LABEL", "A/B", "WHAT?", "TAB\t"} {
+		if err := fs.SetVolumeLabel(label); err == nil {
+			t.Errorf("expected error for label %q", label)
+		}
+		if _, err := FormatFS(make(RAMDisk, 4096*80000), label, false); err == nil {
+			t.Errorf("expected format error for label %q", label)
+		}
+	}
+	if label := string(fs.BootSector.VolLab()); label != "BACKUP 2   " {
+		t.Errorf("label changed after failed update: %q", label)
+	}
+}
+
+func TestReadFATFallback(t *testing.T) {
+	dev := &badSectorDevice{RAMDisk: make(RAMDisk, 4096*80000), bad: map[uint32]bool{}}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := fs.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFAT(cluster, 1337); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.bad[fs.fatSectors[0]] = true
+	contents, copyIdx, err := fs.ReadFATCopy(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents != 1337 || copyIdx != 1 {
+		t.Errorf("expected (1337, 1) but got (%d, %d)", contents, copyIdx)
+	}
+	if _, err := RootDirChain(fs).ReadAll(1 << 20); err != nil {
+		t.Error(err)
+	}
+
+	dev.bad[fs.fatSectors[1]] = true
+	if _, err := fs.ReadFAT(cluster); err == nil {
+		t.Error("expected error when all FATs are unreadable")
+	}
+}
+
+type badSectorDevice struct {
+	RAMDisk
+	bad map[uint32]bool
+}
+
+func (b *badSectorDevice) ReadSector(idx uint32) (*Sector, error) {
+	if b.bad[idx] {
+		return nil, errors.New("bad sector")
+	}
+	return b.RAMDisk.ReadSector(idx)
+}
+
+// droppedWriteDevice ignores writes to some sectors.
+type droppedWriteDevice struct {
+	RAMDisk
+	dropped map[uint32]bool
+}
+
+func (d *droppedWriteDevice) WriteSector(idx uint32, value *Sector) error {
+	if d.dropped[idx] {
+		return nil
+	}
+	return d.RAMDisk.WriteSector(idx, value)
+}
+
+func TestValidateFormat(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ValidateFormat(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ValidateFormat(); err != nil {
+		t.Error(err)
+	}
+
+	fatStart := uint32(fs.BootSector.RsvdSecCnt())
+	secondFAT := fatStart + fs.BootSector.FatSz32()
+	for _, dropped := range []uint32{1, fatStart, secondFAT} {
+		dev := &droppedWriteDevice{
+			RAMDisk: make(RAMDisk, 4096*80000),
+			dropped: map[uint32]bool{dropped: true},
+		}
+		fs, err := FormatFS(dev, "FOO", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.ValidateFormat(); err == nil {
+			t.Errorf("sector %d: expected error", dropped)
+		}
+	}
+}
+
+func TestDataRegion(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, count := fs.DataRegion()
+	b := fs.BootSector
+	if expected := uint32(b.RsvdSecCnt()) + 2*b.FatSz32(); first != expected {
+		t.Errorf("expected first sector %d but got %d", expected, first)
+	}
+	if first+count != b.TotSec32() {
+		t.Errorf("data region ends at %d instead of %d", first+count, b.TotSec32())
+	}
+
+	chain := RootDirChain(fs)
+	data := make([]byte, fs.ClusterSize())
+	data[0] = 0x37
+	if err := chain.WriteCluster(data); err != nil {
+		t.Fatal(err)
+	}
+	sector, err := dev.ReadSector(first + (b.RootClus()-2)*uint32(b.SecPerClus()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sector[0] != 0x37 {
+		t.Error("root cluster was not at the expected sector")
+	}
+}
+
+func TestNewFSWithType(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	if _, err := FormatFS(dev, "FOO", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFSWithType(dev, FAT32); err != nil {
+		t.Error(err)
+	}
+	for _, fatType := range []FATType{FAT12, FAT16} {
+		if _, err := NewFSWithType(dev, fatType); err == nil {
+			t.Errorf("expected error for %s", fatType)
+		}
+	}
+
+	sector, _ := dev.ReadSector(0)
+	bs := BootSector(*sector)
+	bs.SetRootClus(0)
+	sector = (*Sector)(&bs)
+	dev.WriteSector(0, sector)
+	if _, err := NewFSWithType(dev, FAT32); err == nil {
+		t.Error("expected error for invalid root cluster")
+	}
+}
+
+func TestAllocCursor(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectAlloc := func(expected uint32) {
+		if actual, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		} else if actual != expected {
+			t.Fatalf("expected cluster %d but got %d", expected, actual)
+		}
+	}
+
+	// Freeing through the FS moves the cursor back.
+	if err := fs.WriteFAT(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectAlloc(5)
+	expectAlloc(13)
+
+	// Freeing behind the FS's back does not.
+	other, err := NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.WriteFAT(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectAlloc(14)
+	fs.ResetAllocCursor()
+	expectAlloc(4)
+	expectAlloc(15)
+}
+
+func TestNextFreeHint(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hint := range []uint32{100, 0xffffffff, fs.NumClusters(), 1} {
+		sector, err := dev.ReadSector(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Endian.PutUint32(sector[492:496], hint)
+		if err := dev.WriteSector(1, sector); err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFS(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := uint32(3)
+		if hint == 100 {
+			expected = 100
+		}
+		if cluster, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		} else if cluster != expected {
+			t.Errorf("hint %#x: expected cluster %d but got %d", hint, expected, cluster)
+		}
+		if err := fs.WriteFAT(expected, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	sizes := []uint32{8 * 65525, 8*65525 + 13, 640000}
+	if !testing.Short() {
+		// This volume takes 1 GiB of memory.
+		sizes = append(sizes, 1<<21)
+	}
+	for _, numSectors := range sizes {
+		dev := make(RAMDisk, numSectors*SectorSize)
+		fs, err := FormatFS(dev, "FOO", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.selfTest(); err != nil {
+			t.Errorf("%d sectors: %s", numSectors, err)
+		}
+	}
+
+	for _, geometry := range [][2]int{{1, 2}, {64, 2}, {128, 1}, {8, 3}} {
+		dev := make(RAMDisk, 4096*80000)
+		bs, err := NewBootSector32(dev.NumSectors(), "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs.SetSecPerClus(uint8(geometry[0]))
+		bs.SetNumFATs(uint8(geometry[1]))
+		if geometry[0] == 1 {
+			bs.SetFatSz32(bs.FatSz32() * 8)
+		}
+		sector := Sector(*bs)
+		if err := dev.WriteSector(0, &sector); err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFS(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.selfTest(); err != nil {
+			t.Errorf("geometry %v: %s", geometry, err)
+		}
+	}
+
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.BootSector.SetFatSz32(fs.BootSector.FatSz32() / 2)
+	if err := fs.selfTest(); err == nil {
+		t.Error("expected error for a shrunken FAT")
+	}
+}
+
+func TestFormatBootCode(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	code := []byte{0xfa, 0xf4, 0xeb, 0xfd}
+	fs, err := FormatFSWithOptions(dev, &FormatOptions{Label: "BOOT", BootCode: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCode := func() {
+		if !bytes.Equal(dev[BootCodeOffset:BootCodeOffset+len(code)], code) {
+			t.Error("boot code was not written")
+		}
+		if dev[0] != 0xeb || int(dev[1])+2 != BootCodeOffset {
+			t.Error("jump does not target the boot code")
+		}
+		if dev[510] != 0x55 || dev[511] != 0xaa {
+			t.Error("missing boot signature")
+		}
+	}
+	checkCode()
+	if string(fs.BootSector.VolLab()) != "BOOT       " {
+		t.Errorf("unexpected label %q", fs.BootSector.VolLab())
+	}
+
+	if _, err := FormatFSWithOptions(dev, &FormatOptions{PreserveBootCode: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkCode()
+	if _, err := FormatFS(dev, "FOO", false); err != nil {
+		t.Fatal(err)
+	}
+	if dev[BootCodeOffset] != 0 {
+		t.Error("boot code was not cleared")
+	}
+
+	_, err = FormatFSWithOptions(dev, &FormatOptions{BootCode: make([]byte, BootCodeSize+1)})
+	if err == nil {
+		t.Error("expected error for oversized boot code")
+	}
+}
+
+func TestFATSizeBytes(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := fs.FATSizeBytes()
+	required := fs.RequiredFATSizeBytes()
+	if actual != int64(fs.BootSector.FatSz32())*SectorSize {
+		t.Errorf("unexpected FAT size %d", actual)
+	}
+	if required%SectorSize != 0 || required < int64(fs.NumClusters())*4 ||
+		required-SectorSize >= int64(fs.NumClusters())*4 {
+		t.Errorf("unexpected required size %d for %d clusters", required, fs.NumClusters())
+	}
+	if required > actual {
+		t.Errorf("required size %d exceeds actual size %d", required, actual)
+	}
+}
+
+func TestFormatSingleFAT(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	for i := range dev[:SectorSize*20000] {
+		dev[i] = 0xff
+	}
+	fs, err := FormatFSWithOptions(dev, &FormatOptions{Label: "FOO", Erase: true, NumFATs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.BootSector.NumFATs() != 1 || len(fs.fatSectors) != 1 {
+		t.Fatalf("expected 1 FAT but got %d", fs.BootSector.NumFATs())
+	}
+	first, _ := fs.DataRegion()
+	if first != uint32(fs.BootSector.RsvdSecCnt())+fs.BootSector.FatSz32() {
+		t.Errorf("unexpected first data sector %d", first)
+	}
+
+	// The erased region must end at the data region.
+	if dev[first*SectorSize-1] != 0 || dev[first*SectorSize] != 0xff {
+		t.Error("erase did not cover exactly the reserved sectors and FAT")
+	}
+
+	var writes int
+	fs.OnSectorWrite = func(sector uint32) {
+		writes++
+	}
+	if _, err := fs.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+	if writes != 1 {
+		t.Errorf("expected 1 sector write but got %d", writes)
+	}
+
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.selfTest(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := FormatFSWithOptions(dev, &FormatOptions{NumFATs: 3}); err == nil {
+		t.Error("expected error for 3 FATs")
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.Local)
+	fs.SetClock(func() time.Time {
+		return fixed
+	})
+	dir, err := fs.MkdirAll("a/b", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(dir, "c.txt", bytes.NewReader(nil), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "a/b", "a/b/c.txt"} {
+		entry, err := fs.Lookup(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := entry.Raw().ModTime(); !actual.Equal(fixed) {
+			t.Errorf("%s: expected %v but got %v", path, fixed, actual)
+		}
+	}
+
+	explicit := time.Date(2010, time.May, 6, 7, 8, 10, 0, time.Local)
+	if _, err := CreateFile(dir, "d.txt", bytes.NewReader(nil), explicit); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := fs.Lookup("a/b/d.txt"); err != nil {
+		t.Fatal(err)
+	} else if actual := entry.Raw().ModTime(); !actual.Equal(explicit) {
+		t.Errorf("expected %v but got %v", explicit, actual)
+	}
+}
+
+func TestFATSectorAccess(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sector, err := fs.ReadFATSector(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 128; i++ {
+		expected := uint32(0)
+		if 128+i <= 202 {
+			expected = EOF
+		}
+		if actual := fatEntry(sector, i*4); actual != expected {
+			t.Fatalf("entry %d: expected %#x but got %#x", 128+i, expected, actual)
+		}
+	}
+
+	// Free the first 10 entries of sector 1.
+	for i := 0; i < 10; i++ {
+		setFATEntry(sector, i*4, 0)
+	}
+	if err := fs.WriteFATSector(1, sector); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range fs.fatSectors {
+		if copied, err := dev.ReadSector(offset + 1); err != nil {
+			t.Fatal(err)
+		} else if *copied != *sector {
+			t.Error("FAT copy was not updated")
+		}
+	}
+	if cluster, err := fs.Alloc(); err != nil {
+		t.Fatal(err)
+	} else if cluster != 128 {
+		t.Errorf("expected to allocate freed cluster 128 but got %d", cluster)
+	}
+
+	if _, err := fs.ReadFATSector(fs.BootSector.FatSz32()); err == nil {
+		t.Error("expected error for out of range sector")
+	}
+	if err := fs.WriteFATSector(fs.BootSector.FatSz32(), sector); err == nil {
+		t.Error("expected error for out of range sector")
+	}
+}
+
+func TestClusterBounds(t *testing.T) {
+	dev := make(RAMDisk, 8*65525*SectorSize)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dataSectors := fs.DataRegion()
+	if count := fs.DataClusterCount(); count != dataSectors/8 {
+		t.Errorf("expected %d data clusters but got %d", dataSectors/8, count)
+	}
+	if fs.MaxClusterIndex() != fs.DataClusterCount()+1 {
+		t.Errorf("unexpected max cluster index %d", fs.MaxClusterIndex())
+	}
+	if free, err := fs.CountFreeClusters(); err != nil {
+		t.Fatal(err)
+	} else if free != fs.DataClusterCount()-1 {
+		t.Errorf("expected %d free clusters but got %d", fs.DataClusterCount()-1, free)
+	}
+
+	var last uint32
+	for {
+		cluster, err := fs.Alloc()
+		if err != nil {
+			break
+		}
+		last = cluster
+	}
+	if last != fs.MaxClusterIndex() {
+		t.Errorf("expected last allocation %d but got %d", fs.MaxClusterIndex(), last)
+	}
+	if free, err := fs.CountFreeClusters(); err != nil {
+		t.Fatal(err)
+	} else if free != 0 {
+		t.Errorf("expected no free clusters but got %d", free)
+	}
+
+	// The last cluster must be entirely within the device.
+	data := make([]byte, fs.ClusterSize())
+	data[len(data)-1] = 0x37
+	if err := NewChain(fs, last).WriteCluster(data); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := fs.DataRegion()
+	end := int(first+(last-1)*8) * SectorSize
+	if end > len(dev) || dev[end-1] != 0x37 {
+		t.Error("last cluster was not at the end of the data region")
+	}
+	if err := NewChain(fs, last+1).WriteCluster(data); err == nil {
+		t.Error("expected error writing past the last cluster")
+	}
+}
+
+func TestCrossLinkCheck(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, 0)
+	for i := 0; i < 3; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt the FAT so that the middle of the chain
+	// appears to be free.
+	other, err := NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.WriteFAT(4, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expectAlloc := func(expected uint32) {
+		if actual, err := fs.Alloc(); err != nil {
+			t.Fatal(err)
+		} else if actual != expected {
+			t.Fatalf("expected cluster %d but got %d", expected, actual)
+		}
+	}
+	if err := fs.EnableCrossLinkCheck(); err != nil {
+		t.Fatal(err)
+	}
+	fs.ResetAllocCursor()
+	expectAlloc(6)
+
+	// Freed clusters can be reused.
+	chain = NewChain(fs, 6)
+	for i := 0; i < 2; i++ {
+		if err := chain.Extend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chain.Free(); err != nil {
+		t.Fatal(err)
+	}
+	fs.ResetAllocCursor()
+	expectAlloc(6)
+	expectAlloc(7)
+	expectAlloc(8)
+
+	fs.DisableCrossLinkCheck()
+	fs.ResetAllocCursor()
+	expectAlloc(4)
+}
+
+func TestAllocatedChains(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]uint32{
+		{100, 101}, {101, 102}, {102, EOF},
+		{200, 101},
+		{300, 301}, {301, 300},
+		{400, badCluster},
+	}
+	for _, link := range links {
+		if err := fs.WriteFAT(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chains, err := fs.AllocatedChains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]uint32{{2}, {100, 101, 102}, {200}, {300, 301}}
+	if !reflect.DeepEqual(chains, expected) {
+		t.Errorf("expected %v but got %v", expected, chains)
+	}
+}
+
+func TestFSError(t *testing.T) {
+	dev := &badSectorDevice{RAMDisk: make(RAMDisk, 4096*80000), bad: map[uint32]bool{}}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(fs, 0)
+	if err := chain.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	cluster := chain.FirstCluster()
+	firstData, _ := fs.DataRegion()
+	clusterSector := firstData + (cluster-2)*uint32(fs.BootSector.SecPerClus())
+	dev.bad[clusterSector+1] = true
+	fatSector := fs.fatSectors[0] + cluster/128
+	for _, offset := range fs.fatSectors {
+		dev.bad[offset+cluster/128] = true
+	}
+
+	check := func(err error, op string, sector uint32) {
+		var fsErr *FSError
+		if !errors.As(err, &fsErr) {
+			t.Errorf("%s: expected *FSError but got %v", op, err)
+			return
+		}
+		if fsErr.Op != op || fsErr.Cluster != cluster || fsErr.Sector != sector {
+			t.Errorf("%s: unexpected error fields: %+v", op, fsErr)
+		}
+		if err.Error() != op+": bad sector" {
+			t.Errorf("%s: unexpected message: %s", op, err)
+		}
+	}
+	_, err = chain.ReadCluster()
+	check(err, "ReadCluster", clusterSector+1)
+	_, err = fs.ReadFAT(cluster)
+	check(err, "ReadFAT", fatSector)
+	err = fs.WriteFAT(cluster, EOF)
+	check(err, "WriteFAT", fatSector)
+}
+
+func TestReservedSectors(t *testing.T) {
+	for _, reserved := range []int{2, 37, 4001} {
+		dev := make(RAMDisk, 4096*80000)
+		fs, err := FormatFSWithOptions(dev, &FormatOptions{Label: "FOO", ReservedSectors: reserved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(fs.BootSector.RsvdSecCnt()) != reserved || fs.fatSectors[0] != uint32(reserved) {
+			t.Fatalf("unexpected FAT location: %v", fs.fatSectors)
+		}
+		dir, err := fs.MkdirAll("a/b", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 20000)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		file, err := CreateFile(dir, "data.bin", bytes.NewReader(data), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs, err = NewFS(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := fs.ReadFile("a/b/data.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, data) {
+			t.Errorf("reserved %d: unexpected contents", reserved)
+		}
+
+		// Check the on-disk layout against the BPB directly.
+		firstData := uint32(reserved) + 2*fs.BootSector.FatSz32()
+		cluster := file.Chain.FirstCluster()
+		start := int(firstData+(cluster-2)*uint32(fs.BootSector.SecPerClus())) * SectorSize
+		if !bytes.Equal(dev[start:start+fs.ClusterSize()], data[:fs.ClusterSize()]) {
+			t.Errorf("reserved %d: data is not at the expected sector", reserved)
+		}
+		fatSector, err := dev.ReadSector(uint32(reserved) + cluster/128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next, _ := fs.ReadFAT(cluster); fatEntry(fatSector, int(cluster%128)*4) != next {
+			t.Errorf("reserved %d: FAT entry is not at the expected sector", reserved)
+		}
+	}
+
+	dev := make(RAMDisk, 4096*80000)
+	for _, reserved := range []int{1, 0x10000} {
+		if _, err := FormatFSWithOptions(dev, &FormatOptions{ReservedSectors: reserved}); err == nil {
+			t.Errorf("expected error for %d reserved sectors", reserved)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(NewDir(fs.RootDir()), "a.txt", bytes.NewReader(make([]byte, 10000)),
+		time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFAT(1, EOF&^cleanShutdownBit); err != nil {
+		t.Fatal(err)
+	}
+	free, err := fs.CountFreeClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	for _, err := range []error{
+		fs.Sync(),
+		fs.WriteFAT(100, EOF),
+		NewChain(fs, 2).WriteClusterZero(),
+	} {
+		if err == nil || !strings.HasSuffix(err.Error(), ErrClosed.Error()) {
+			t.Errorf("expected ErrClosed but got %v", err)
+		}
+	}
+	if _, err := fs.Lookup("a.txt"); err == nil {
+		t.Error("expected error after close")
+	}
+
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.ReadFSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.FreeCount != free || info.NextFree != 6 {
+		t.Errorf("unexpected FSInfo: %+v", info)
+	}
+	if flags, err := fs.ReadFAT(1); err != nil {
+		t.Fatal(err)
+	} else if flags&cleanShutdownBit == 0 {
+		t.Error("clean shutdown bit is not set")
+	}
+
+	if _, err := fs.Lookup("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if flags, err := fs.ReadFAT(1); err != nil {
+		t.Fatal(err)
+	} else if flags&cleanShutdownBit == 0 {
+		t.Error("clean shutdown bit was cleared by a read")
+	}
+	if _, err := CreateFile(NewDir(fs.RootDir()), "b.txt", bytes.NewReader([]byte("hi")),
+		time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags, err := fs.ReadFAT(1); err != nil {
+		t.Fatal(err)
+	} else if flags&cleanShutdownBit != 0 {
+		t.Error("clean shutdown bit was not cleared by a write")
+	}
+}
+
+func TestFreeRanges(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := fs.MaxClusterIndex()
+	used := []uint32{3, 4, 10, 1000, 1001, max}
+	for _, cluster := range used {
+		if err := fs.WriteFAT(cluster, EOF); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ranges, err := fs.FreeRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ClusterRange{{5, 5}, {11, 989}, {1002, max - 1002}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v but got %v", expected, ranges)
+	}
+	start, length, err := fs.LargestFreeRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1002 || length != max-1002 {
+		t.Errorf("unexpected largest run: %d, %d", start, length)
+	}
+}
+
+func TestLoadFAT(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("a/b", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	if _, err := CreateFile(dir, "data.bin", bytes.NewReader(data), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.LoadFAT(); err != nil {
+		t.Fatal(err)
+	}
+
+	firstData, _ := fs.DataRegion()
+	var fatReads int
+	fs.OnSectorRead = func(sector uint32) {
+		if sector < firstData {
+			fatReads++
+		}
+	}
+	if actual, err := fs.ReadFile("a/b/data.bin"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(actual, data) {
+		t.Error("unexpected contents")
+	}
+	if fatReads != 0 {
+		t.Errorf("expected no FAT reads but got %d", fatReads)
+	}
+
+	// Writes must keep the loaded FAT coherent.
+	if err := fs.WriteFAT(500, 1234); err != nil {
+		t.Fatal(err)
+	}
+	var sector Sector
+	setFATEntry(&sector, 4*4, 5678)
+	if err := fs.WriteFATSector(10, &sector); err != nil {
+		t.Fatal(err)
+	}
+	log := fs.BeginDryRun()
+	if err := fs.WriteFAT(500, 1); err != nil {
+		t.Fatal(err)
+	}
+	log.Discard()
+	err = fs.Transaction(func(tx *Tx) error {
+		if err := tx.FS.WriteFAT(500, 2); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected transaction error")
+	}
+	err = fs.Transaction(func(tx *Tx) error {
+		return tx.FS.WriteFAT(501, 7)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Device = failedWriteDevice{dev}
+	if err := fs.WriteFAT(500, 3); err == nil {
+		t.Fatal("expected write error")
+	}
+	fs.Device = dev
+	for _, loaded := range []bool{true, false} {
+		if !loaded {
+			fs.UnloadFAT()
+		}
+		if contents, err := fs.ReadFAT(500); err != nil || contents != 1234 {
+			t.Errorf("loaded=%v: expected 1234 but got %d, %v", loaded, contents, err)
+		}
+		if contents, err := fs.ReadFAT(10*128 + 4); err != nil || contents != 5678 {
+			t.Errorf("loaded=%v: expected 5678 but got %d, %v", loaded, contents, err)
+		}
+		if contents, err := fs.ReadFAT(501); err != nil || contents != 7 {
+			t.Errorf("loaded=%v: expected 7 but got %d, %v", loaded, contents, err)
+		}
+	}
+}
+
+// failedWriteDevice fails every write.
+type failedWriteDevice struct {
+	RAMDisk
+}
+
+func (f failedWriteDevice) WriteSector(idx uint32, value *Sector) error {
+	return errors.New("write failed")
+}
+
+func TestFATType(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.IsFAT32() || fs.FATType() != FAT32 {
+		t.Errorf("expected FAT32 but got %s", fs.FATType())
+	}
+
+	bs := *fs.BootSector
+	fat16 := &FS{BootSector: &bs}
+	bs.SetTotSec32(0)
+	bs.SetTotSec16(60000)
+	bs.SetFatSz32(0)
+	bs.SetFatSz16(30)
+	bs.SetRootEntCnt(512)
+	bs.SetSecPerClus(1)
+	if fat16.IsFAT32() || fat16.FATType() != FAT16 {
+		t.Errorf("expected FAT16 but got %s", fat16.FATType())
+	}
+	bs.SetSecPerClus(16)
+	if fat16.FATType() != FAT12 {
+		t.Errorf("expected FAT12 but got %s", fat16.FATType())
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFSWithOptions(dev, &FormatOptions{Label: "FOO", ReservedSectors: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := fs.Geometry()
+	fatSize := fs.BootSector.FatSz32()
+	expected := Geometry{
+		BytesPerSector:    512,
+		SectorsPerCluster: 8,
+		ClusterSize:       4096,
+		ReservedSectors:   32,
+		NumFATs:           2,
+		FATSectors:        fatSize,
+		FirstDataSector:   32 + 2*fatSize,
+		DataSectors:       dev.NumSectors() - (32 + 2*fatSize),
+		NumClusters:       fs.NumClusters(),
+	}
+	if g != expected {
+		t.Errorf("expected %+v but got %+v", expected, g)
+	}
+}
+
+func TestReservedFATEntries(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media, err := fs.MediaType(); err != nil {
+		t.Fatal(err)
+	} else if media != fs.BootSector.Media() {
+		t.Errorf("media type 0x%x does not match boot sector 0x%x", media, fs.BootSector.Media())
+	}
+	if err := fs.WriteFAT(1, EOF&^cleanShutdownBit); err != nil {
+		t.Fatal(err)
+	}
+	if marker, err := fs.EndOfChainMarker(); err != nil {
+		t.Fatal(err)
+	} else if marker != EOF&^cleanShutdownBit {
+		t.Errorf("unexpected marker: 0x%x", marker)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker, err := fs.EndOfChainMarker(); err != nil {
+		t.Fatal(err)
+	} else if marker&cleanShutdownBit == 0 {
+		t.Errorf("expected clean shutdown bit in 0x%x", marker)
+	}
+}
+
+func TestTotSec16(t *testing.T) {
+	bs, err := NewBootSector32(8*65525, "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.SetTotSec16(60000)
+	if bs.TotSec() != 8*65525 {
+		t.Errorf("TotSec32 should take precedence but got %d", bs.TotSec())
+	}
+	bs.SetTotSec32(0)
+	if bs.TotSec() != 60000 {
+		t.Errorf("expected TotSec16 to be used but got %d", bs.TotSec())
+	}
+
+	bs.SetSecPerClus(1)
+	bs.SetFatSz32(ceilDiv(60000, SectorSize/4))
+	dev := make(RAMDisk, SectorSize*60000)
+	if err := dev.WriteSector(0, (*Sector)(bs)); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstData, _ := fs.DataRegion()
+	if expected := 2 + 60000 - firstData; fs.NumClusters() != expected {
+		t.Errorf("expected %d clusters but got %d", expected, fs.NumClusters())
+	}
+	for i := uint32(0); i < 3; i++ {
+		if err := fs.WriteFAT(i, EOF); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := CreateFile(NewDir(fs.RootDir()), "file.txt", bytes.NewReader([]byte("hello")),
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile("file.txt"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+
+	bs.SetTotSec16(60001)
+	if err := dev.WriteSector(0, (*Sector)(bs)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFS(dev); err == nil {
+		t.Error("expected error for volume larger than device")
+	}
+}
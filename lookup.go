@@ -0,0 +1,279 @@
+package fatfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// Lookup finds the directory entry for a path.
+//
+// The path is checked and normalized with CleanPath, and
+// each path element is matched with Dir.Lookup.
+//
+// The root directory has no entry of its own, so it
+// cannot be looked up.
+//
+// If any element of the path is missing, ErrNotExist is
+// returned.
+func (f *FS) Lookup(path string) (DirEntry, error) {
+	_, entry, _, err := f.lookup(path)
+	return entry, err
+}
+
+// An EntryLocation is where a short entry is stored in a
+// directory: the 32 bytes at ByteOffset within the cluster
+// at ClusterOffset in Dir.
+//
+// It can be found with FS.EntryLocationOf.
+type EntryLocation struct {
+	Dir           *Chain
+	ClusterOffset int64
+	ByteOffset    int
+}
+
+// EntryLocation finds where the short entry for a path is
+// stored, so that it can be modified in place.
+//
+// The entry is the 32 bytes at byteOffset within the
+// cluster at clusterOffset in dirChain.
+func (f *FS) EntryLocation(path string) (dirChain *Chain, clusterOffset int64, byteOffset int,
+	err error) {
+	parent, _, loc, err := f.lookup(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return parent.Chain, loc.cluster, loc.offset, nil
+}
+
+// EntryLocationOf is like EntryLocation, but it returns
+// the location as an EntryLocation, as used by
+// FS.SetFileSize.
+func (f *FS) EntryLocationOf(path string) (EntryLocation, error) {
+	dirChain, clusterOffset, byteOffset, err := f.EntryLocation(path)
+	if err != nil {
+		return EntryLocation{}, err
+	}
+	return EntryLocation{Dir: dirChain, ClusterOffset: clusterOffset, ByteOffset: byteOffset}, nil
+}
+
+// Exists checks if a path refers to a file or directory.
+//
+// A path does not exist if any element of it is missing,
+// or if a non-final element is not a directory.
+// An error is only returned if the path is invalid or if
+// the file-system cannot be read.
+// The root directory always exists.
+func (f *FS) Exists(path string) (bool, error) {
+	names, err := CleanPath(path)
+	if err != nil {
+		return false, err
+	} else if len(names) == 0 {
+		return true, nil
+	}
+	_, _, _, err = f.lookup(path)
+	if err == nil {
+		return true, nil
+	} else if _, ok := err.(notDirError); ok || err == os.ErrNotExist {
+		return false, nil
+	}
+	return false, err
+}
+
+// OpenDir opens the directory at a path.
+// The empty path and "/" refer to the root directory.
+func (f *FS) OpenDir(path string) (*Dir, error) {
+	if names, err := CleanPath(path); err != nil {
+		return nil, essentials.AddCtx("OpenDir", err)
+	} else if len(names) == 0 {
+		return NewDir(f.RootDir()), nil
+	}
+	_, entry, _, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Raw().IsDir() {
+		return nil, errors.New("OpenDir: not a directory")
+	}
+	return NewDir(NewChain(f, entry.Raw().FirstCluster())), nil
+}
+
+// OpenFile opens the regular file at a path.
+//
+// Writes through the File update its directory entry.
+func (f *FS) OpenFile(path string) (*File, error) {
+	parent, entry, loc, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Raw().IsDir() {
+		return nil, errors.New("OpenFile: is a directory")
+	}
+	chain := NewChain(f, entry.Raw().FirstCluster())
+	file := NewFile(chain, int64(entry.Raw().FileSize()))
+	file.entryDir, file.entryLoc = parent.Chain, loc
+	return file, nil
+}
+
+// OpenByCluster opens the regular file whose first
+// cluster is first, searching the whole directory tree for
+// its entry to find its size.
+//
+// Since a file keeps its first cluster when it is renamed
+// or moved, or when its directory is rewritten, the first
+// cluster can identify a file like an inode number.
+// Empty files have no clusters, so they cannot be opened
+// this way.
+// If the size is already known, OpenChain avoids the
+// search.
+//
+// If no file is found, ErrNotExist is returned.
+func (f *FS) OpenByCluster(first uint32) (*File, error) {
+	if first < 2 || first >= f.NumClusters() {
+		return nil, essentials.AddCtx("OpenByCluster", ErrInvalidCluster)
+	}
+	visited := map[uint32]bool{}
+	var search func(dir *Dir) (DirEntry, error)
+	search = func(dir *Dir) (DirEntry, error) {
+		visited[dir.Chain.FirstCluster()] = true
+		entries, err := dir.ReadDir()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			raw := entry.Raw()
+			if raw.IsDotPointer() || raw.Attr()&VolumeID != 0 {
+				continue
+			}
+			if !raw.IsDir() {
+				if raw.FirstCluster() == first {
+					return entry, nil
+				}
+			} else if cluster := raw.FirstCluster(); !visited[cluster] {
+				if found, err := search(NewDir(NewChain(f, cluster))); found != nil || err != nil {
+					return found, err
+				}
+			}
+		}
+		return nil, nil
+	}
+	entry, err := search(NewDir(f.RootDir()))
+	if err != nil {
+		return nil, essentials.AddCtx("OpenByCluster", err)
+	} else if entry == nil {
+		return nil, os.ErrNotExist
+	}
+	return NewFile(NewChain(f, first), int64(entry.Raw().FileSize())), nil
+}
+
+// MkdirAll opens the directory at a path, creating it
+// and any missing parent directories.
+func (f *FS) MkdirAll(path string, date time.Time) (dir *Dir, err error) {
+	defer essentials.AddCtxTo("MkdirAll", &err)
+	names, err := CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	dir = NewDir(f.RootDir())
+	for _, name := range names {
+		entry, err := dir.Lookup(name)
+		if err == os.ErrNotExist {
+			dir, err = Mkdir(dir, name, date)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !entry.Raw().IsDir() {
+			return nil, errors.New("not a directory: " + name)
+		}
+		dir = NewDir(NewChain(f, entry.Raw().FirstCluster()))
+	}
+	return dir, nil
+}
+
+// lookup finds the entry for a path, along with the
+// directory containing it and the location of its short
+// entry in that directory.
+func (f *FS) lookup(path string) (parent *Dir, entry DirEntry, loc rawLocation, err error) {
+	names, err := CleanPath(path)
+	if err != nil {
+		return nil, nil, loc, essentials.AddCtx("Lookup", err)
+	} else if len(names) == 0 {
+		return nil, nil, loc, errors.New("Lookup: root directory has no entry")
+	}
+	parent = NewDir(f.RootDir())
+	for i, name := range names {
+		entry, loc, err = parent.lookup(name)
+		if err != nil {
+			if err != os.ErrNotExist {
+				err = essentials.AddCtx("Lookup", err)
+			}
+			return nil, nil, loc, err
+		}
+		if i == len(names)-1 {
+			break
+		}
+		if !entry.Raw().IsDir() {
+			return nil, nil, loc, notDirError(name)
+		}
+		parent = NewDir(NewChain(f, entry.Raw().FirstCluster()))
+	}
+	return parent, entry, loc, nil
+}
+
+// CleanPath checks a path and splits it into the names
+// used to traverse it from the root directory.
+//
+// Paths are slash-separated and relative to the root
+// directory, with an optional leading slash.
+// The empty path and "/" refer to the root directory and
+// have no components.
+// The rules for other paths are:
+//
+//   - Backslashes are not allowed.
+//   - Components may not be empty, so a path cannot
+//     contain "//" or end with a slash.
+//   - "." components are removed.
+//   - ".." removes the previous component, and it is an
+//     error for ".." to go above the root directory.
+//
+// The names are not otherwise validated, since existing
+// entries may have names that ValidateName rejects.
+func CleanPath(p string) (components []string, err error) {
+	if strings.Contains(p, "\\") {
+		return nil, errors.New("CleanPath: path contains a backslash")
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		switch name {
+		case "":
+			return nil, errors.New("CleanPath: path contains an empty component")
+		case ".":
+		case "..":
+			if len(components) == 0 {
+				return nil, errors.New("CleanPath: path escapes the root directory")
+			}
+			components = components[:len(components)-1]
+		default:
+			components = append(components, name)
+		}
+	}
+	return components, nil
+}
+
+// A notDirError is returned by lookup when a path goes
+// through something other than a directory.
+type notDirError string
+
+func (n notDirError) Error() string {
+	return "Lookup: not a directory: " + string(n)
+}
@@ -0,0 +1,257 @@
+package fatfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("/photos/2017/summer", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []byte("hello, world!")
+	if _, err := CreateFile(dir, "Beach Day.txt", bytes.NewReader(contents), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.MkdirAll("photos/2017", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"photos/2017/summer/Beach Day.txt",
+		"/PHOTOS/2017/Summer/beach day.TXT", "photos/2017/summer/BEACH DA.TXT"} {
+		entry, err := fs.Lookup(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if entry.Name() != "Beach Day.txt" {
+			t.Errorf("%s: unexpected name %s", path, entry.Name())
+		}
+	}
+
+	file, err := fs.OpenFile("photos/2017/summer/beach day.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]byte, file.Size)
+	if _, err := file.ReadAt(actual, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, contents) {
+		t.Error("unexpected file contents")
+	}
+
+	root, err := fs.OpenDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing, err := root.ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 1 || listing[0].Name() != "photos" {
+		t.Errorf("unexpected root listing: %v", listing)
+	}
+
+	for _, path := range []string{"photos/2018", "photos/2017/summer/missing.txt", "nothing"} {
+		if _, err := fs.Lookup(path); err != os.ErrNotExist {
+			t.Errorf("%s: expected ErrNotExist but got %v", path, err)
+		}
+	}
+	if _, err := fs.Lookup("photos/2017/summer/beach day.txt/foo"); err == nil {
+		t.Error("expected error for file used as directory")
+	}
+	if _, err := fs.OpenDir("photos/2017/summer/beach day.txt"); err == nil {
+		t.Error("expected error opening file as directory")
+	}
+	if _, err := fs.OpenFile("photos"); err == nil {
+		t.Error("expected error opening directory as file")
+	}
+	if _, err := fs.Lookup("photos/2017/../2018"); err != os.ErrNotExist {
+		t.Errorf("expected ErrNotExist but got %v", err)
+	}
+	if _, err := fs.Lookup("photos/./2017/summer/../summer/beach day.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	valid := map[string][]string{
+		"":              nil,
+		"/":             nil,
+		"foo":           {"foo"},
+		"/foo/bar":      {"foo", "bar"},
+		"foo/./bar":     {"foo", "bar"},
+		"foo/../bar":    {"bar"},
+		"foo/bar/../..": nil,
+		"a b/c.txt":     {"a b", "c.txt"},
+	}
+	for path, expected := range valid {
+		actual, err := CleanPath(path)
+		if err != nil {
+			t.Errorf("%q: %v", path, err)
+		} else if len(actual) != len(expected) ||
+			strings.Join(actual, "/") != strings.Join(expected, "/") {
+			t.Errorf("%q: expected %q but got %q", path, expected, actual)
+		}
+	}
+	for _, path := range []string{"..", "/foo/../..", "foo\\bar", "foo//bar", "foo/", "//"} {
+		if _, err := CleanPath(path); err == nil {
+			t.Errorf("%q: expected error", path)
+		}
+	}
+}
+
+func TestEntryLocation(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("data", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("a long file name %d.txt", i)
+		if _, err := CreateFile(dir, name, bytes.NewReader(nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain, clusterOffset, byteOffset, err := fs.EntryLocation("data/a long file name 150.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusterOffset == 0 {
+		t.Error("expected entry beyond the first cluster")
+	}
+	if _, err := chain.Seek(clusterOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := chain.ReadCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw RawDirEntry
+	copy(raw[:], cluster[byteOffset:])
+	entry, err := fs.Lookup("data/a long file name 150.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != *entry.Raw() {
+		t.Fatal("entry location does not contain the short entry")
+	}
+
+	raw.SetAttr(raw.Attr() | ReadOnly)
+	copy(cluster[byteOffset:], raw[:])
+	if err := chain.WriteCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = fs.Lookup("data/a long file name 150.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Raw().Attr()&ReadOnly == 0 {
+		t.Error("attribute change was not visible")
+	}
+	entry, err = fs.Lookup("data/a long file name 149.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Raw().Attr()&ReadOnly != 0 {
+		t.Error("wrong entry was modified")
+	}
+}
+
+func TestExists(t *testing.T) {
+	dev := &badSectorDevice{RAMDisk: make(RAMDisk, 4096*80000), bad: map[uint32]bool{}}
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("docs/old", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(dir, "notes.txt", bytes.NewReader(nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]bool{
+		"":                        true,
+		"/":                       true,
+		"docs":                    true,
+		"DOCS/Old/NOTES.TXT":      true,
+		"docs/new":                false,
+		"docs/new/notes.txt":      false,
+		"docs/old/notes.txt/more": false,
+	} {
+		if actual, err := fs.Exists(path); err != nil {
+			t.Errorf("%q: %v", path, err)
+		} else if actual != expected {
+			t.Errorf("%q: expected %v but got %v", path, expected, actual)
+		}
+	}
+
+	sector, err := NewChain(fs, dir.Chain.FirstCluster()).clusterSector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.bad[sector] = true
+	if _, err := fs.Exists("docs/old/notes.txt"); err == nil {
+		t.Error("expected error for unreadable directory")
+	}
+}
+
+func TestOpenByCluster(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.MkdirAll("a/b/c", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(dir, "other.txt", bytes.NewReader([]byte("other")),
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	file, err := CreateFile(dir, "file.txt", bytes.NewReader([]byte("hello, world")), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := fs.OpenByCluster(file.Chain.FirstCluster())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(opened.Section(0, opened.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello, world" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+
+	dirEntry, err := fs.Lookup("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenByCluster(dirEntry.Raw().FirstCluster()); err != os.ErrNotExist {
+		t.Errorf("expected ErrNotExist for directory but got %v", err)
+	}
+	if _, err := fs.OpenByCluster(1); err == nil {
+		t.Error("expected error for invalid cluster")
+	}
+}
@@ -0,0 +1,89 @@
+package fatfs
+
+import (
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A DirEntryRecord describes a directory entry in a form
+// that is easy to serialize, e.g. as JSON.
+type DirEntryRecord struct {
+	// Name is the long name, or the formatted short name
+	// if there is no long name.
+	Name string `json:"name"`
+
+	// ShortName is the formatted short name.
+	ShortName string `json:"shortName"`
+
+	Attr         uint8     `json:"attr"`
+	IsDir        bool      `json:"isDir"`
+	Size         uint32    `json:"size"`
+	FirstCluster uint32    `json:"firstCluster"`
+	Created      time.Time `json:"created"`
+	Modified     time.Time `json:"modified"`
+
+	// Deleted is true for a deleted entry, whose name
+	// starts with '?' since its first character is lost.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// MarshalDir lists the live entries in a directory as
+// records, with long names assembled.
+//
+// The "." and ".." entries and the volume label are not
+// included.
+func (f *FS) MarshalDir(dir *Chain) ([]DirEntryRecord, error) {
+	return f.marshalDir(dir, false)
+}
+
+// MarshalDirAll is like MarshalDir, but it also includes
+// the volume label and any deleted short entries, which
+// come after the live entries.
+func (f *FS) MarshalDirAll(dir *Chain) ([]DirEntryRecord, error) {
+	return f.marshalDir(dir, true)
+}
+
+func (f *FS) marshalDir(dir *Chain, all bool) (records []DirEntryRecord, err error) {
+	defer essentials.AddCtxTo("MarshalDir", &err)
+	entries, _, err := NewDir(dir).readDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		raw := entry.Raw()
+		if raw.IsDotPointer() || (!all && raw.Attr()&VolumeID != 0) {
+			continue
+		}
+		record := newDirEntryRecord(raw)
+		record.Name = entry.Name()
+		record.ShortName = entry.ShortNameString()
+		records = append(records, record)
+	}
+	if !all {
+		return records, nil
+	}
+	deleted, err := f.ScanDeleted(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range deleted {
+		record := newDirEntryRecord(entry.Raw)
+		record.Name = entry.Name
+		record.ShortName = entry.Name
+		record.Deleted = true
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func newDirEntryRecord(raw *RawDirEntry) DirEntryRecord {
+	return DirEntryRecord{
+		Attr:         raw.Attr(),
+		IsDir:        raw.IsDir(),
+		Size:         raw.FileSize(),
+		FirstCluster: raw.FirstCluster(),
+		Created:      raw.CreationTime(),
+		Modified:     raw.ModTime(),
+	}
+}
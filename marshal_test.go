@@ -0,0 +1,68 @@
+package fatfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMarshalDir(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	date := time.Date(2015, 3, 14, 15, 9, 26, 0, time.Local)
+	if _, err := Mkdir(root, "Some Directory", date); err != nil {
+		t.Fatal(err)
+	}
+	file, err := CreateFile(root, "notes.txt", bytes.NewReader([]byte("hello")), date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := NewRawDirEntry(FormatName("GONE.TXT"), 0, 0, date, false)
+	deleted[0] = 0xe5
+	if err := root.AddRawEntry(deleted); err != nil {
+		t.Fatal(err)
+	}
+	label := NewRawDirEntry(FormatName("FOO"), 0, 0, date, false)
+	label.SetAttr(VolumeID)
+	if err := root.AddRawEntry(label); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := fs.MarshalDir(fs.RootDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if r := records[0]; r.Name != "Some Directory" || !r.IsDir || r.Attr != Directory {
+		t.Errorf("unexpected directory record: %+v", r)
+	}
+	r := records[1]
+	if r.Name != "notes.txt" || r.ShortName != "notes.txt" || r.Size != 5 ||
+		r.FirstCluster != file.Chain.FirstCluster() || !r.Modified.Equal(date) ||
+		!r.Created.Equal(date) || r.Deleted {
+		t.Errorf("unexpected file record: %+v", r)
+	}
+
+	all, err := fs.MarshalDirAll(fs.RootDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sawLabel, sawDeleted bool
+	for _, r := range all {
+		if r.Attr&VolumeID != 0 {
+			sawLabel = true
+		}
+		if r.Deleted && r.Name == "?ONE.TXT" {
+			sawDeleted = true
+		}
+	}
+	if len(all) < 4 || !sawLabel || !sawDeleted {
+		t.Errorf("unexpected records: %+v", all)
+	}
+}
@@ -17,6 +17,14 @@ const (
 	LongName  = 0x0f
 )
 
+// Case flags stored in a short entry's NTRes field.
+// They indicate that the base name or extension should be
+// displayed in lowercase.
+const (
+	LowerCaseBase = 0x08
+	LowerCaseExt  = 0x10
+)
+
 // NewRawDirEntry creates a RawDirEntry given some
 // meta-data about a file.
 //
@@ -27,8 +35,7 @@ func NewRawDirEntry(name string, cluster, size uint32, creation time.Time, dir b
 	}
 	var res RawDirEntry
 	copy(res.Name(), []byte(name))
-	res.SetFstClusLO(uint16(cluster))
-	res.SetFstClusHI(uint16(cluster >> 16))
+	res.SetFirstCluster(cluster)
 	res.SetFileSize(size)
 	res.SetCrtDate(fatDate(creation))
 	res.SetCrtTime(fatTime(creation))
@@ -46,6 +53,12 @@ func (r *RawDirEntry) FirstCluster() uint32 {
 	return uint32(r.FstClusLO()) | (uint32(r.FstClusHI()) << 16)
 }
 
+// SetFirstCluster sets the first cluster of the file.
+func (r *RawDirEntry) SetFirstCluster(cluster uint32) {
+	r.SetFstClusLO(uint16(cluster))
+	r.SetFstClusHI(uint16(cluster >> 16))
+}
+
 // IsFree checks if the directory entry is a free slot.
 func (r *RawDirEntry) IsFree() bool {
 	return r.Name()[0] == 0 || r.Name()[0] == 0xe5
@@ -56,6 +69,11 @@ func (r *RawDirEntry) IsLongName() bool {
 	return r.Attr()&0x3f == LongName
 }
 
+// IsDir checks if this entry is for a directory.
+func (r *RawDirEntry) IsDir() bool {
+	return r.Attr()&Directory == Directory
+}
+
 // IsDotPointer checks if this is "." or "..".
 func (r *RawDirEntry) IsDotPointer() bool {
 	return string(r.Name()) == ".          " || string(r.Name()) == "..         "
@@ -89,6 +107,35 @@ func UnformatName(name string) string {
 	}
 }
 
+// ModTime decodes the entry's last write date and time.
+//
+// FAT timestamps do not record a time zone, so the result
+// is in the local time zone.
+// Times are stored with a 2 second resolution.
+func (r *RawDirEntry) ModTime() time.Time {
+	return decodeFATTime(r.WrtDate(), r.WrtTime())
+}
+
+// CreationTime decodes the entry's creation date and
+// time, including the 10 millisecond units stored in
+// CrtTimeTenth.
+// Like ModTime, the result is in the local time zone.
+func (r *RawDirEntry) CreationTime() time.Time {
+	t := decodeFATTime(r.CrtDate(), r.CrtTime())
+	return t.Add(time.Duration(r.CrtTimeTenth()) * 10 * time.Millisecond)
+}
+
+// copyTimes copies all of the timestamps from another
+// entry.
+func (r *RawDirEntry) copyTimes(source *RawDirEntry) {
+	r.SetCrtTimeTenth(source.CrtTimeTenth())
+	r.SetCrtTime(source.CrtTime())
+	r.SetCrtDate(source.CrtDate())
+	r.SetLstAccDate(source.LstAccDate())
+	r.SetWrtTime(source.WrtTime())
+	r.SetWrtDate(source.WrtDate())
+}
+
 func spacePad(str string, length int) string {
 	if len(str) > length {
 		return str[:length]
@@ -106,3 +153,8 @@ func fatDate(t time.Time) uint16 {
 func fatTime(t time.Time) uint16 {
 	return (uint16(t.Second()) / 2) | (uint16(t.Minute()) << 5) | (uint16(t.Hour()) << 11)
 }
+
+func decodeFATTime(date, t uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month((date>>5)&0xf), int(date&0x1f),
+		int(t>>11), int((t>>5)&0x3f), int(t&0x1f)*2, 0, time.Local)
+}
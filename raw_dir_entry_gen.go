@@ -18,6 +18,18 @@ func (r *RawDirEntry) SetAttr(x uint8) {
 	r[11] = x
 }
 
+func (r *RawDirEntry) RawNTRes() []byte {
+	return r[12 : 12+1]
+}
+
+func (r *RawDirEntry) NTRes() uint8 {
+	return r[12]
+}
+
+func (r *RawDirEntry) SetNTRes(x uint8) {
+	r[12] = x
+}
+
 func (r *RawDirEntry) RawCrtTimeTenth() []byte {
 	return r[13 : 13+1]
 }
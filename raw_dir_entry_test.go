@@ -0,0 +1,20 @@
+package fatfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawDirEntryTimes(t *testing.T) {
+	created := time.Date(2019, time.March, 14, 15, 9, 27, 0, time.Local)
+	entry := NewRawDirEntry(FormatName("foo.txt"), 0, 0, created, false)
+	expected := time.Date(2019, time.March, 14, 15, 9, 26, 0, time.Local)
+	if actual := entry.ModTime(); !actual.Equal(expected) {
+		t.Errorf("expected mod time %v but got %v", expected, actual)
+	}
+	entry.SetCrtTimeTenth(150)
+	expected = expected.Add(1500 * time.Millisecond)
+	if actual := entry.CreationTime(); !actual.Equal(expected) {
+		t.Errorf("expected creation time %v but got %v", expected, actual)
+	}
+}
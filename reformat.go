@@ -0,0 +1,182 @@
+package fatfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/unixpickle/essentials"
+)
+
+// ReformatPreserveLimit is the maximum total size of the
+// files that ReformatPreserving will keep, since they are
+// held in memory while the volume is formatted.
+const ReformatPreserveLimit = 64 << 20
+
+// ReformatPreserving formats the volume with a new label,
+// keeping only the regular files at the paths in keep.
+//
+// The kept files are read into memory, the volume is
+// formatted with its FATs erased, and then the files are
+// written back, along with any parent directories they
+// need.
+// Their names, attributes, and timestamps are preserved.
+// The number and size of the FATs and the boot code are
+// also preserved.
+//
+// Before anything is changed, it is an error for the kept
+// files to total more than ReformatPreserveLimit bytes, for
+// them to need more clusters than the reformatted volume
+// will have, or for two of them to have the same path once
+// case is ignored.
+//
+// On success, f refers to the reformatted volume.
+func (f *FS) ReformatPreserving(label string, keep []string) (err error) {
+	defer essentials.AddCtxTo("ReformatPreserving", &err)
+
+	type keptFile struct {
+		parent string
+		entry  DirEntry
+		data   []byte
+	}
+	var files []keptFile
+	var total int64
+	// children maps each directory to be written, by its
+	// upper-case path, to the names of its new entries.
+	children := map[string][]string{"": nil}
+	keptPaths := map[string]bool{}
+	for _, path := range keep {
+		names, err := CleanPath(path)
+		if err != nil {
+			return err
+		}
+		entry, err := f.Lookup(path)
+		if err != nil {
+			return err
+		}
+		if entry.Raw().IsDir() {
+			return errors.New("not a regular file: " + path)
+		}
+		total += int64(entry.Raw().FileSize())
+		if total > ReformatPreserveLimit {
+			return fmt.Errorf("files to keep exceed %d bytes", ReformatPreserveLimit)
+		}
+		data, err := f.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		parent := strings.Join(names[:len(names)-1], "/")
+		for i := 1; i < len(names); i++ {
+			dir := strings.ToUpper(strings.Join(names[:i], "/"))
+			if _, ok := children[dir]; !ok {
+				children[dir] = nil
+				dirParent := strings.ToUpper(strings.Join(names[:i-1], "/"))
+				children[dirParent] = append(children[dirParent], names[i-1])
+			}
+		}
+		key := strings.ToUpper(strings.Join(append(names[:len(names)-1:len(names)-1],
+			entry.Name()), "/"))
+		if keptPaths[key] {
+			return essentials.AddCtx(path, os.ErrExist)
+		}
+		keptPaths[key] = true
+		children[strings.ToUpper(parent)] = append(children[strings.ToUpper(parent)], entry.Name())
+		files = append(files, keptFile{parent: parent, entry: entry, data: data})
+	}
+
+	opts := &FormatOptions{
+		Label:            label,
+		Erase:            true,
+		NumFATs:          int(f.BootSector.NumFATs()),
+		PreserveBootCode: true,
+	}
+	bs, err := NewBootSector32(f.Device.NumSectors(), label)
+	if err != nil {
+		return err
+	}
+	bs.SetNumFATs(uint8(opts.NumFATs))
+	newGeometry := &FS{BootSector: bs}
+	clusterSize := int64(newGeometry.ClusterSize())
+	var needed int64
+	for dir, names := range children {
+		// Entries cannot span clusters, and every directory
+		// but the root starts with "." and "..".
+		needed++
+		used := 2
+		if dir == "" {
+			used = 0
+		}
+		for _, name := range names {
+			slots := maxEntrySlots(name)
+			if used+slots > int(clusterSize/32) {
+				needed++
+				used = 0
+			}
+			used += slots
+		}
+	}
+	for _, file := range files {
+		needed += (int64(len(file.data)) + clusterSize - 1) / clusterSize
+	}
+	if needed > int64(newGeometry.DataClusterCount()) {
+		return ErrNoSpace
+	}
+
+	newFS, err := formatFS(f.Device, opts)
+	if err != nil {
+		return err
+	}
+	if err := NewChain(newFS, newFS.BootSector.RootClus()).WriteClusterZero(); err != nil {
+		return err
+	}
+	newFS.OnSectorRead = f.OnSectorRead
+	newFS.OnSectorWrite = f.OnSectorWrite
+	newFS.clock = f.clock
+	if f.refCounts != nil {
+		if err := newFS.EnableCrossLinkCheck(); err != nil {
+			return err
+		}
+	}
+	*f = *newFS
+
+	for _, file := range files {
+		dir, err := f.MkdirAll(file.parent, f.now())
+		if err != nil {
+			return err
+		}
+		name := file.entry.Name()
+		shortNames, err := checkNewName(dir, name)
+		if err != nil {
+			return err
+		}
+		chain := NewChain(f, 0)
+		if _, err := chain.ReadFrom(bytes.NewReader(file.data)); err != nil {
+			chain.Free()
+			return err
+		}
+		entry, err := shortNames.unique(name,
+			NewDirEntry(name, chain.FirstCluster(), uint32(len(file.data)), f.now(), false))
+		if err != nil {
+			chain.Free()
+			return err
+		}
+		entry.Raw().SetAttr(file.entry.Raw().Attr())
+		entry.Raw().copyTimes(file.entry.Raw())
+		if err := dir.AddEntry(entry); err != nil {
+			chain.Free()
+			return err
+		}
+	}
+	return nil
+}
+
+// maxEntrySlots gets the number of 32-byte slots that a
+// directory entry for a name uses if it needs a long name,
+// which it may even if the name fits in a short name,
+// since a numeric tail may be added.
+func maxEntrySlots(name string) int {
+	return 1 + (len(utf16.Encode([]rune(name)))+12)/13
+}
@@ -0,0 +1,120 @@
+package fatfs
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReformatPreserving(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2015, 3, 14, 15, 9, 26, 0, time.UTC)
+	configDir, err := fs.MkdirAll("etc/app", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := make([]byte, 10000)
+	rand.Read(config)
+	if _, err := CreateFile(configDir, "Settings.json", bytes.NewReader(config), date); err != nil {
+		t.Fatal(err)
+	}
+	scratch, err := fs.MkdirAll("scratch", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if _, err := CreateFile(scratch, name, bytes.NewReader(make([]byte, 50000)), date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.ReformatPreserving("BAR", []string{"scratch"}); err == nil {
+		t.Error("expected error keeping a directory")
+	}
+	for _, keep := range [][]string{
+		{"etc/app/settings.json", "ETC/APP/SETTINGS.JSON"},
+		{"etc/app/Settings.json", "etc/app/SETTINGS.JSO"},
+	} {
+		if err := fs.ReformatPreserving("BAR", keep); err == nil {
+			t.Errorf("%v: expected error for duplicate paths", keep)
+		}
+		if exists, err := fs.Exists("scratch/a.bin"); err != nil || !exists {
+			t.Fatalf("%v: volume was modified, got (%v, %v)", keep, exists, err)
+		}
+	}
+	if err := fs.ReformatPreserving("BAR", []string{"etc/app/settings.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := fs.Exists("scratch"); err != nil || exists {
+		t.Errorf("expected scratch to be removed, got (%v, %v)", exists, err)
+	}
+	entry, err := fs.Lookup("etc/app/settings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name() != "Settings.json" || !entry.Raw().ModTime().Equal(date.Local()) {
+		t.Errorf("unexpected entry: %s %v", entry.Name(), entry.Raw().ModTime())
+	}
+	data, err := fs.ReadFile("etc/app/settings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, config) {
+		t.Error("unexpected contents")
+	}
+
+	reopened, err := NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := NewDir(reopened.RootDir()).ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Name() != "etc" {
+		t.Errorf("unexpected root listing: %v", listing)
+	}
+
+	// The old chains must be freed, leaving exactly the
+	// clusters of a fresh volume minus the kept file and
+	// its two directories.
+	fresh, err := FormatFS(make(RAMDisk, len(dev)), "BAR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshFree, err := fresh.CountFreeClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := fs.ClusterSize()
+	expectedFree := freshFree - uint32((len(config)+clusterSize-1)/clusterSize) - 2
+	if free, err := fs.CountFreeClusters(); err != nil {
+		t.Fatal(err)
+	} else if free != expectedFree {
+		t.Errorf("expected %d free clusters but got %d", expectedFree, free)
+	}
+
+	if err := fs.ReformatPreserving("BAR", []string{"missing.txt"}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestMaxEntrySlots(t *testing.T) {
+	for name, expected := range map[string]int{
+		"A.TXT":                2,
+		"thirteen char":        2,
+		"fourteen chars":       3,
+		strings.Repeat("😀", 7): 3,
+	} {
+		if actual := maxEntrySlots(name); actual != expected {
+			t.Errorf("%q: expected %d but got %d", name, expected, actual)
+		}
+	}
+}
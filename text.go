@@ -0,0 +1,51 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+
+	"github.com/unixpickle/essentials"
+)
+
+// ReadText reads the file at a path as text.
+//
+// If the file starts with a UTF-8, UTF-16LE, or UTF-16BE
+// byte order mark, it is decoded accordingly and the mark
+// is removed.
+// Otherwise, the contents are assumed to be UTF-8.
+func (f *FS) ReadText(path string) (string, error) {
+	data, err := f.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	text, err := decodeText(data)
+	if err != nil {
+		return "", essentials.AddCtx("ReadText", err)
+	}
+	return text, nil
+}
+
+func decodeText(data []byte) (string, error) {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return string(data[3:]), nil
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	default:
+		return string(data), nil
+	}
+	data = data[2:]
+	if len(data)%2 != 0 {
+		return "", errors.New("UTF-16 text has odd length")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
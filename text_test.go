@@ -0,0 +1,44 @@
+package fatfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadText(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	files := map[string][]byte{
+		"plain.txt": []byte("héllo"),
+		"utf8.txt":  []byte("\xef\xbb\xbfhéllo"),
+		"le.txt":    {0xff, 0xfe, 'h', 0, 0xe9, 0, 'l', 0, 'l', 0, 'o', 0},
+		"be.txt":    {0xfe, 0xff, 0, 'h', 0, 0xe9, 0, 'l', 0, 'l', 0, 'o'},
+	}
+	for name, data := range files {
+		if _, err := CreateFile(root, name, bytes.NewReader(data), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name := range files {
+		text, err := fs.ReadText(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if text != "héllo" {
+			t.Errorf("%s: got %q", name, text)
+		}
+	}
+
+	if _, err := CreateFile(root, "odd.txt", bytes.NewReader([]byte{0xff, 0xfe, 'h'}),
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadText("odd.txt"); err == nil {
+		t.Error("expected error for odd-length UTF-16")
+	}
+}
@@ -0,0 +1,57 @@
+package fatfs
+
+import "github.com/unixpickle/essentials"
+
+// A Tx is a transaction started by FS.Transaction.
+type Tx struct {
+	// FS is a view of the file-system that buffers all of
+	// its writes in memory.
+	// Reads through FS see the buffered writes.
+	FS *FS
+}
+
+// Transaction runs fn with a transaction, and applies the
+// writes it made only if fn returns nil.
+// If fn returns an error, the writes are discarded and
+// the error is returned.
+//
+// All changes must be made through tx.FS.
+// The FS should not be modified by other means while fn
+// is running.
+//
+// Committed writes are applied in ascending sector order,
+// so the FAT is updated before the data region.
+// The commit is not atomic with respect to crashes: an
+// interrupted commit may leave the volume inconsistent,
+// for example with directory entries that refer to freed
+// clusters.
+func (f *FS) Transaction(fn func(tx *Tx) error) error {
+	overlay := newOverlayDevice(f.Device, nil)
+	txFS := *f
+	bootSector := *f.BootSector
+	txFS.BootSector = &bootSector
+	txFS.Device = overlay
+	if f.refCounts != nil {
+		txFS.refCounts = append([]uint8{}, f.refCounts...)
+	}
+	if f.fatCache != nil {
+		// The loaded FAT is copied by whichever FS writes to
+		// it first.
+		f.fatCacheShared = true
+		txFS.fatCacheShared = true
+	}
+	if err := fn(&Tx{FS: &txFS}); err != nil {
+		return err
+	}
+	if err := overlay.Flush(); err != nil {
+		return essentials.AddCtx("Transaction", err)
+	}
+	*f.BootSector = bootSector
+	f.refCounts = txFS.refCounts
+	f.fatCache = txFS.fatCache
+	f.fatCacheShared = txFS.fatCacheShared
+	f.allocCursor = txFS.allocCursor
+	f.dirty = txFS.dirty
+	f.closed = txFS.closed
+	return nil
+}
@@ -0,0 +1,98 @@
+package fatfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createFiles := func(tx *Tx) error {
+		dir, err := tx.FS.MkdirAll("files", time.Now())
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("file %d.txt", i)
+			contents := bytes.NewReader([]byte(name))
+			if _, err := CreateFile(dir, name, contents, time.Now()); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.FS.Lookup("files/file 49.txt"); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	failure := errors.New("failure")
+	err = fs.Transaction(func(tx *Tx) error {
+		if err := createFiles(tx); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if listing, err := NewDir(fs.RootDir()).ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 0 {
+		t.Errorf("rolled back transaction left %d entries", len(listing))
+	}
+	if cluster, err := fs.Alloc(); err != nil {
+		t.Fatal(err)
+	} else if cluster != 3 {
+		t.Errorf("rolled back transaction allocated clusters (got %d)", cluster)
+	}
+	if err := fs.WriteFAT(3, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var txCursor uint32
+	err = fs.Transaction(func(tx *Tx) error {
+		if err := createFiles(tx); err != nil {
+			return err
+		}
+		txCursor = tx.FS.allocCursor
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.allocCursor != txCursor {
+		t.Errorf("expected alloc cursor %d but got %d", txCursor, fs.allocCursor)
+	}
+	fs, err = NewFS(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.OpenDir("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing, err := dir.ReadDir(); err != nil {
+		t.Fatal(err)
+	} else if len(listing) != 52 {
+		t.Errorf("expected 52 entries but got %d", len(listing))
+	}
+	file, err := fs.OpenFile("files/file 7.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, file.Size)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "file 7.txt" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+}
@@ -0,0 +1,61 @@
+package fatfs
+
+import (
+	"errors"
+
+	"github.com/unixpickle/essentials"
+)
+
+// ErrStopWalk can be returned by the callback passed to
+// AllEntries to end the walk early.
+// It is not returned by AllEntries itself.
+var ErrStopWalk = errors.New("stop walk")
+
+// AllEntries calls fn with every entry in the directory
+// tree, along with its slash-separated path from the root
+// and the location of its short entry.
+//
+// Each directory's entries are visited in order, and a
+// directory's contents are visited right after its entry.
+// The "." and ".." entries and the volume label are
+// skipped.
+// A directory which has already been visited, as in a
+// corrupt volume with a directory cycle, is not visited
+// again.
+//
+// If fn returns an error, the walk stops.
+// If the error is ErrStopWalk, AllEntries returns nil;
+// otherwise, it returns the error.
+func (f *FS) AllEntries(fn func(path string, d DirEntry, loc EntryLocation) error) error {
+	visited := map[uint32]bool{}
+	var walk func(dir *Chain, prefix string) error
+	walk = func(dir *Chain, prefix string) error {
+		visited[dir.FirstCluster()] = true
+		entries, locs, err := NewDir(dir).readDir()
+		if err != nil {
+			return essentials.AddCtx("AllEntries", err)
+		}
+		for i, entry := range entries {
+			raw := entry.Raw()
+			if raw.IsDotPointer() || raw.Attr()&VolumeID != 0 {
+				continue
+			}
+			path := prefix + entry.Name()
+			loc := EntryLocation{Dir: dir, ClusterOffset: locs[i].cluster, ByteOffset: locs[i].offset}
+			if err := fn(path, entry, loc); err != nil {
+				return err
+			}
+			if raw.IsDir() && !visited[raw.FirstCluster()] {
+				if err := walk(NewChain(f, raw.FirstCluster()), path+"/"); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(f.RootDir(), "")
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package fatfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllEntries(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"docs/old", "music"} {
+		if _, err := fs.MkdirAll(dir, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"docs/readme.txt", "docs/old/notes.txt", "top.txt"} {
+		dirPath, name := splitPathParent(path)
+		dir, err := fs.OpenDir(dirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateFile(dir, name, bytes.NewReader([]byte(path)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	err = fs.AllEntries(func(path string, d DirEntry, loc EntryLocation) error {
+		paths = append(paths, path)
+		if d.Raw().IsDir() {
+			return nil
+		}
+		return fs.SetFileSize(&d, loc, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"docs", "docs/old", "docs/old/notes.txt", "docs/readme.txt", "music",
+		"top.txt"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v but got %v", expected, paths)
+	}
+	for _, path := range []string{"docs/readme.txt", "docs/old/notes.txt", "top.txt"} {
+		if entry, err := fs.Lookup(path); err != nil {
+			t.Fatal(err)
+		} else if entry.Raw().FileSize() != 1 {
+			t.Errorf("%s: size was not updated", path)
+		}
+	}
+
+	paths = nil
+	err = fs.AllEntries(func(path string, d DirEntry, loc EntryLocation) error {
+		paths = append(paths, path)
+		if path == "docs/old" {
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, expected[:2]) {
+		t.Errorf("expected %v but got %v", expected[:2], paths)
+	}
+}
@@ -0,0 +1,35 @@
+package fatfs
+
+import (
+	"context"
+
+	"github.com/unixpickle/essentials"
+)
+
+// WipeFreeSpace overwrites every free cluster with zeros,
+// so that no data from deleted files remains in them.
+//
+// Allocated, reserved, and bad clusters are not touched.
+// If ctx is cancelled, the wipe stops early and returns
+// the context's error.
+func (f *FS) WipeFreeSpace(ctx context.Context) (err error) {
+	defer essentials.AddCtxTo("WipeFreeSpace", &err)
+	zeros := make([]byte, f.ClusterSize())
+	r := newFATReader(f)
+	for cluster := uint32(2); cluster < f.NumClusters(); cluster++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		contents, err := r.Read(cluster)
+		if err != nil {
+			return err
+		}
+		if contents != 0 {
+			continue
+		}
+		if err := NewChain(f, cluster).WriteCluster(zeros); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package fatfs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWipeFreeSpace(t *testing.T) {
+	dev := make(RAMDisk, 4096*80000)
+	fs, err := FormatFS(dev, "FOO", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewDir(fs.RootDir())
+	data := bytes.Repeat([]byte{0x37}, 3*fs.ClusterSize())
+	deleted, err := CreateFile(root, "deleted.bin", bytes.NewReader(data), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := CreateFile(root, "kept.bin", bytes.NewReader(data), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedClusters, err := deleted.Chain.AppendClusters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(root, "deleted.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fs.WipeFreeSpace(ctx); err == nil {
+		t.Error("expected error from cancelled context")
+	}
+	if err := fs.WipeFreeSpace(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cluster := range deletedClusters {
+		contents, err := NewChain(fs, cluster).ReadCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, make([]byte, len(contents))) {
+			t.Errorf("cluster %d was not wiped", cluster)
+		}
+	}
+	var keptData bytes.Buffer
+	if _, err := kept.Chain.WriteTo(&keptData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keptData.Bytes(), data) {
+		t.Error("allocated clusters were modified")
+	}
+}